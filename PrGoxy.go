@@ -1,24 +1,160 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/WangYihang/PrGoxy/lib/admin"
 	"github.com/WangYihang/PrGoxy/lib/config"
 	"github.com/WangYihang/PrGoxy/lib/model"
+	"github.com/WangYihang/PrGoxy/lib/upgrade"
+	"github.com/WangYihang/PrGoxy/lib/util/log"
 )
 
+// Settings are taken from, in order of precedence:
+//
+//	command line flags
+//	PRGOXY_* environment variables
+//	config file
 func main() {
-	// Sync config.json
-	go func() {
-		for {
-			config.Cfg.Reload()
-			time.Sleep(time.Second * 3)
+	flag.StringVar(&config.Path, "config", Getenv("PRGOXY_CONFIG", config.Path), "config file `path` (PRGOXY_CONFIG)")
+	flag.StringVar(&config.Override.Listen, "listen", os.Getenv("PRGOXY_LISTEN"), "proxy listen `host:port`, overrides proxy.lhost/lport (PRGOXY_LISTEN)")
+	flag.StringVar(&config.Override.Cache, "cache", os.Getenv("PRGOXY_CACHE"), "enable cache, `true|false`, overrides cache (PRGOXY_CACHE)")
+	flag.StringVar(&config.Override.LogLevel, "log-level", os.Getenv("PRGOXY_LOG_LEVEL"), "log `level`: data, debug, info, tunnel, success, warn or error, overrides log.level (PRGOXY_LOG_LEVEL)")
+	flag.StringVar(&config.Override.Record, "record", os.Getenv("PRGOXY_RECORD"), "record exchanges to the archive at `path`, overrides replay (PRGOXY_RECORD)")
+	flag.StringVar(&config.Override.Replay, "replay", os.Getenv("PRGOXY_REPLAY"), "answer requests from the archive at `path`, overrides replay (PRGOXY_REPLAY)")
+	checkConfig := flag.Bool("check-config", false, "validate the config and exit")
+	flag.Parse()
+
+	// Applied at once so loading the config is logged at this level too
+	if config.Override.LogLevel != "" {
+		err := log.SetLevel(config.Override.LogLevel)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	if *checkConfig {
+		_, err := config.Check()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", config.Path, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: OK\n", config.Path)
+		return
+	}
+
+	log.Info("Loading config from %s", config.Path)
+	err := config.Reload()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// Reload config on change or SIGHUP
+	go config.Watch()
+	cfg := config.Get()
+	var servers []*model.TCPServer
+	for _, listener := range cfg.ListenerList() {
+		servers = append(servers, model.CreateTCPServer(listener))
+	}
+	for _, server := range servers {
+		err := server.Listen()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Listen failed: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	var adminServer *admin.AdminServer
+	if cfg.Admin.LPort != 0 {
+		adminServer = admin.CreateAdminServer(
+			cfg.Admin.LHost,
+			cfg.Admin.LPort,
+			servers,
+		)
+		err := adminServer.Listen()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Admin listen failed: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	// Every socket is bound, the process we are upgrading from can go
+	upgrade.Ready()
+	// Start servers
+	if adminServer != nil {
+		go adminServer.Run()
+	}
+	for _, server := range servers {
+		go server.Run()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+	for sig := range signals {
+		if sig != syscall.SIGUSR2 {
+			log.Info("%s received, shutting down", sig)
+			break
+		}
+		// Hand the sockets to a new process, then drain like a shutdown
+		log.Info("SIGUSR2 received, upgrading")
+		err := upgrade.Upgrade()
+		if err != nil {
+			log.Error("Upgrade failed: %s", err)
+			continue
 		}
+		log.Info("New process is serving, draining")
+		break
+	}
+	go func() {
+		<-signals
+		log.Warn("Second signal received, exiting now")
+		log.Flush()
+		os.Exit(1)
 	}()
-	// Start server
-	server := model.CreateTCPServer(
-		config.Cfg.Proxy.LHost,
-		config.Cfg.Proxy.LPort,
-	)
-	server.Run()
+	timeout := time.Duration(config.Get().ShutdownTimeout) * time.Second
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	Shutdown(ctx, servers, adminServer)
+	// Spans of the last requests
+	model.Spans.Flush()
+	log.Info("Bye")
+	log.Flush()
+}
+
+// Shutdown stops every server at once and waits for them to drain
+func Shutdown(ctx context.Context, servers []*model.TCPServer, adminServer *admin.AdminServer) {
+	wg := new(sync.WaitGroup)
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *model.TCPServer) {
+			defer wg.Done()
+			err := server.Shutdown(ctx)
+			if err != nil {
+				log.Warn("Server %s did not drain: %s", server.Listener.Name, err)
+			}
+		}(server)
+	}
+	if adminServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			adminServer.Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func Getenv(key string, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fallback
 }
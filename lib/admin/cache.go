@@ -0,0 +1,105 @@
+package admin
+
+import (
+	"bufio"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/WangYihang/PrGoxy/lib/model"
+)
+
+// HandleCache registers the cache management endpoints
+//
+//	GET  /cache                 list entries
+//	GET  /cache/entry?url=      inspect one entry with its headers
+//	POST /cache/purge?url=      purge by exact url
+//	POST /cache/purge?host=     purge every entry of a host
+//	POST /cache/purge?regex=    purge every entry whose url matches
+//	POST /cache/flush           purge everything
+func (o *AdminServer) HandleCache() {
+	o.Mux.HandleFunc("/cache", func(w http.ResponseWriter, r *http.Request) {
+		if !AllowMethods(w, r, "GET") {
+			return
+		}
+		WriteJSON(w, model.CacheEntries())
+	})
+	o.Mux.HandleFunc("/cache/entry", func(w http.ResponseWriter, r *http.Request) {
+		if !AllowMethods(w, r, "GET") {
+			return
+		}
+		uri := r.URL.Query().Get("url")
+		ok, response := model.CacheHit(uri)
+		if !ok {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		entry := model.CreateCacheEntryInfo(uri, &response)
+		entry.Headers = response.Headers
+		WriteJSON(w, entry)
+	})
+	o.Mux.HandleFunc("/cache/purge", func(w http.ResponseWriter, r *http.Request) {
+		if !AllowMethods(w, r, "POST", "DELETE") {
+			return
+		}
+		query := r.URL.Query()
+		purged := 0
+		switch {
+		case query.Get("url") != "":
+			if model.CachePurge(query.Get("url")) {
+				purged = 1
+			}
+		case query.Get("host") != "":
+			purged = model.CachePurgeHost(query.Get("host"))
+		case query.Get("regex") != "":
+			pattern, err := regexp.Compile(query.Get("regex"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			purged = model.CachePurgeRegexp(pattern)
+		default:
+			http.Error(w, "One of url, host or regex is required", http.StatusBadRequest)
+			return
+		}
+		WriteJSON(w, map[string]int{"purged": purged})
+	})
+	o.Mux.HandleFunc("/cache/flush", func(w http.ResponseWriter, r *http.Request) {
+		if !AllowMethods(w, r, "POST", "DELETE") {
+			return
+		}
+		WriteJSON(w, map[string]int{"purged": model.CacheFlush()})
+	})
+}
+
+// HandlePrefetch registers the cache warm-up endpoint, the request body is a
+// list of urls, one per line, lines starting with # are ignored
+//
+//	POST /cache/prefetch?concurrency=N
+func (o *AdminServer) HandlePrefetch() {
+	o.Mux.HandleFunc("/cache/prefetch", func(w http.ResponseWriter, r *http.Request) {
+		if !AllowMethods(w, r, "POST") {
+			return
+		}
+		concurrency, err := strconv.Atoi(r.URL.Query().Get("concurrency"))
+		if err != nil {
+			concurrency = 4
+		}
+		var urls []string
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			urls = append(urls, line)
+		}
+		if err := scanner.Err(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Upstream connections are tracked by the first listener
+		WriteJSON(w, o.Proxies[0].PrefetchAll(urls, concurrency))
+	})
+}
@@ -0,0 +1,121 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/WangYihang/PrGoxy/lib/model"
+	"github.com/WangYihang/PrGoxy/lib/util/log"
+)
+
+// HandleCaptures registers the HAR capture endpoints. Captures take the
+// filters of the request tail and are kept in memory until deleted.
+//
+//	GET    /captures            list captures
+//	POST   /captures?client=&host=&status=&method=&max_entries=N&max_body=BYTES
+//	                            start a capture
+//	POST   /captures/stop?id=   stop a capture, what it recorded is kept
+//	GET    /captures/har?id=    download a capture as a HAR file
+//	DELETE /captures?id=        delete a capture
+func (o *AdminServer) HandleCaptures() {
+	o.Mux.HandleFunc("/captures", func(w http.ResponseWriter, r *http.Request) {
+		if !AllowMethods(w, r, "GET", "POST", "DELETE") {
+			return
+		}
+		query := r.URL.Query()
+		switch r.Method {
+		case "GET":
+			WriteJSON(w, model.Captures.List())
+		case "POST":
+			filter, err := model.CreateRequestFilter(query)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			maxEntries, err := optionalInt(query.Get("max_entries"))
+			if err != nil {
+				http.Error(w, "Invalid max_entries", http.StatusBadRequest)
+				return
+			}
+			maxBody, err := optionalInt(query.Get("max_body"))
+			if err != nil {
+				http.Error(w, "Invalid max_body", http.StatusBadRequest)
+				return
+			}
+			// Only the filter is kept as description
+			query.Del("max_entries")
+			query.Del("max_body")
+			description, _ := url.QueryUnescape(query.Encode())
+			capture := model.Captures.Start(filter, description, maxEntries, maxBody)
+			log.Info("Capture %d of %q started by %s", capture.ID, capture.Query, r.RemoteAddr)
+			WriteJSON(w, capture.Info())
+		case "DELETE":
+			id, err := strconv.Atoi(query.Get("id"))
+			if err != nil {
+				http.Error(w, "Invalid id", http.StatusBadRequest)
+				return
+			}
+			if !model.Captures.Delete(id) {
+				http.Error(w, "Capture not found", http.StatusNotFound)
+				return
+			}
+			WriteJSON(w, map[string]int{"deleted": id})
+		}
+	})
+	o.Mux.HandleFunc("/captures/stop", func(w http.ResponseWriter, r *http.Request) {
+		if !AllowMethods(w, r, "POST") {
+			return
+		}
+		capture := findCapture(w, r)
+		if capture == nil {
+			return
+		}
+		capture.Stop()
+		WriteJSON(w, capture.Info())
+	})
+	o.Mux.HandleFunc("/captures/har", func(w http.ResponseWriter, r *http.Request) {
+		if !AllowMethods(w, r, "GET") {
+			return
+		}
+		capture := findCapture(w, r)
+		if capture == nil {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"prgoxy-capture-%d.har\"", capture.ID))
+		err := json.NewEncoder(w).Encode(capture.HAR())
+		if err != nil {
+			log.Error("Failed to send capture %d: %s", capture.ID, err)
+		}
+	})
+}
+
+// findCapture looks up the capture of the id parameter, the error is already
+// answered when nil
+func findCapture(w http.ResponseWriter, r *http.Request) *model.Capture {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return nil
+	}
+	capture := model.Captures.Get(id)
+	if capture == nil {
+		http.Error(w, "Capture not found", http.StatusNotFound)
+	}
+	return capture
+}
+
+// optionalInt reads a non negative number, 0 if empty
+func optionalInt(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid number: %q", s)
+	}
+	return n, nil
+}
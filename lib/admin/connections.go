@@ -0,0 +1,54 @@
+package admin
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/WangYihang/PrGoxy/lib/model"
+	"github.com/WangYihang/PrGoxy/lib/util/log"
+)
+
+// HandleConnections registers the live connection endpoints
+//
+//	GET         /connections?kind=&state=  open connections, optionally only
+//	                                       one kind (client or upstream) or state
+//	POST/DELETE /connections/kill?id=      closes a connection
+func (o *AdminServer) HandleConnections() {
+	o.Mux.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+		if !AllowMethods(w, r, "GET") {
+			return
+		}
+		kind := r.URL.Query().Get("kind")
+		state := r.URL.Query().Get("state")
+		connections := []model.ConnectionInfo{}
+		for _, connection := range model.Connections(o.Proxies) {
+			if kind != "" && connection.Kind != kind {
+				continue
+			}
+			if state != "" && connection.State != state {
+				continue
+			}
+			connections = append(connections, connection)
+		}
+		WriteJSON(w, connections)
+	})
+	o.Mux.HandleFunc("/connections/kill", func(w http.ResponseWriter, r *http.Request) {
+		if !AllowMethods(w, r, "POST", "DELETE") {
+			return
+		}
+		id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+		client := model.FindConnection(o.Proxies, id)
+		if client == nil {
+			http.Error(w, "Connection not found", http.StatusNotFound)
+			return
+		}
+		info := client.Info()
+		log.Warn("Killing connection %d from %s to %s (%s)", info.ID, info.Peer, info.Target, info.State)
+		client.Kill()
+		WriteJSON(w, info)
+	})
+}
@@ -0,0 +1,141 @@
+package admin
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/WangYihang/PrGoxy/lib/config"
+	"github.com/WangYihang/PrGoxy/lib/model"
+	"github.com/WangYihang/PrGoxy/lib/util/log"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// HandleDashboard registers the dashboard and the endpoints it reads
+//
+//	GET  /                      redirects to the dashboard
+//	GET  /dashboard/            the dashboard
+//	GET  /stats?top=N           totals, open connections and the top N clients
+//	                            and hosts of the recent requests
+//	GET  /requests/recent?after=SEQ
+//	                            recent requests newer than SEQ
+func (o *AdminServer) HandleDashboard() {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	o.Mux.Handle("/dashboard/", http.StripPrefix("/dashboard/", http.FileServer(http.FS(files))))
+	o.Mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, "/dashboard/", http.StatusFound)
+	})
+	o.Mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if !AllowMethods(w, r, "GET") {
+			return
+		}
+		top, err := strconv.Atoi(r.URL.Query().Get("top"))
+		if err != nil || top <= 0 {
+			top = 10
+		}
+		WriteJSON(w, model.CurrentStats(top))
+	})
+	o.Mux.HandleFunc("/requests/recent", func(w http.ResponseWriter, r *http.Request) {
+		if !AllowMethods(w, r, "GET") {
+			return
+		}
+		after, _ := strconv.ParseUint(r.URL.Query().Get("after"), 10, 64)
+		records, last := model.Recent.After(after)
+		WriteJSON(w, map[string]interface{}{
+			"last":     last,
+			"requests": records,
+		})
+	})
+}
+
+// PolicyRules are the rules of a policy, "" is the default policy
+type PolicyRules struct {
+	Policy string `json:"policy"`
+	config.Rules
+	// Set from the admin API, the config file rules are ignored
+	Edited bool `json:"edited"`
+}
+
+// HandleRules registers the block and redirect rule endpoints, rules set here
+// win over the config file until they are reset or the proxy restarts
+//
+//	GET    /rules               rules of every policy
+//	PUT    /rules?policy=NAME   replace the rules of a policy with the json body
+//	DELETE /rules?policy=NAME   go back to the config file rules
+func (o *AdminServer) HandleRules() {
+	o.Mux.HandleFunc("/rules", func(w http.ResponseWriter, r *http.Request) {
+		if !AllowMethods(w, r, "GET", "PUT", "DELETE") {
+			return
+		}
+		name := r.URL.Query().Get("policy")
+		switch r.Method {
+		case "PUT":
+			// Browsers can't send json across origins without asking first
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if mediaType != "application/json" {
+				http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+			var rules config.Rules
+			decoder := json.NewDecoder(r.Body)
+			decoder.DisallowUnknownFields()
+			err := decoder.Decode(&rules)
+			if err != nil {
+				http.Error(w, "Invalid rules: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			err = config.SetRules(name, rules)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Info("Rules of policy %q set by %s", name, r.RemoteAddr)
+		case "DELETE":
+			if _, ok := config.Get().RulesOf(name); !ok {
+				http.Error(w, "Unknown policy", http.StatusNotFound)
+				return
+			}
+			err := config.ResetRules(name)
+			if err != nil {
+				http.Error(w, "Failed to reload config: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Info("Rules of policy %q reset by %s", name, r.RemoteAddr)
+		}
+		WriteJSON(w, CurrentRules())
+	})
+}
+
+// CurrentRules lists the rules of the default policy, then the named policies
+// in order
+func CurrentRules() []PolicyRules {
+	cfg := config.Get()
+	names := []string{""}
+	for name := range cfg.Policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rules := make([]PolicyRules, 0, len(names))
+	for _, name := range names {
+		policyRules, _ := cfg.RulesOf(name)
+		rules = append(rules, PolicyRules{
+			Policy: name,
+			Rules:  policyRules,
+			Edited: config.RulesEdited(name),
+		})
+	}
+	return rules
+}
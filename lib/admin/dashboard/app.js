@@ -0,0 +1,249 @@
+"use strict";
+
+// Seconds between refreshes, rows kept in the request tail and samples kept
+// in the throughput chart
+const INTERVAL = 2;
+const TAIL_ROWS = 200;
+const SAMPLES = 90;
+
+let previous = null;
+let samples = [];
+let lastSeq = 0;
+
+// Admin actions must carry X-Requested-With, so that other sites can't post
+// them from a form
+function action(path, init) {
+	init = init || {};
+	init.headers = Object.assign({ "X-Requested-With": "XMLHttpRequest" }, init.headers);
+	return fetch(path, init);
+}
+
+async function get(path) {
+	const response = await fetch(path, { cache: "no-store" });
+	if (!response.ok) {
+		throw new Error(path + ": " + (await response.text()).trim());
+	}
+	return response.json();
+}
+
+function bytes(n) {
+	const units = ["B", "KB", "MB", "GB", "TB"];
+	let i = 0;
+	while (n >= 1024 && i < units.length - 1) {
+		n /= 1024;
+		i++;
+	}
+	return (i === 0 ? n : n.toFixed(1)) + " " + units[i];
+}
+
+function since(time) {
+	const seconds = Math.floor((Date.now() - new Date(time)) / 1000);
+	if (seconds < 60) {
+		return seconds + "s";
+	}
+	if (seconds < 3600) {
+		return Math.floor(seconds / 60) + "m";
+	}
+	return Math.floor(seconds / 3600) + "h" + Math.floor(seconds % 3600 / 60) + "m";
+}
+
+// row builds a table row, values are set as text, never parsed as html
+function row(values, classes) {
+	const tr = document.createElement("tr");
+	values.forEach((value, i) => {
+		const td = document.createElement("td");
+		if (value instanceof Node) {
+			td.appendChild(value);
+		} else {
+			td.textContent = value === undefined || value === null ? "" : value;
+		}
+		if (classes && classes[i]) {
+			td.className = classes[i];
+		}
+		tr.appendChild(td);
+	});
+	return tr;
+}
+
+function setText(id, text) {
+	document.getElementById(id).textContent = text;
+}
+
+function setStatus(error) {
+	const status = document.getElementById("status");
+	status.textContent = error ? error.message : "";
+	status.className = error ? "error" : "";
+}
+
+function updateStats(stats) {
+	if (previous) {
+		const seconds = (new Date(stats.time) - new Date(previous.time)) / 1000;
+		const rate = (key) => Math.max(0, stats[key] - previous[key]) / seconds;
+		const sample = {
+			requests: rate("requests"),
+			in: rate("bytes_in"),
+			out: rate("bytes_out"),
+		};
+		samples.push(sample);
+		if (samples.length > SAMPLES) {
+			samples.shift();
+		}
+		setText("rate-requests", sample.requests.toFixed(1));
+		setText("rate-in", bytes(sample.in) + "/s");
+		setText("rate-out", bytes(sample.out) + "/s");
+		drawThroughput();
+	}
+	previous = stats;
+	const lookups = stats.cache_hits + stats.cache_misses;
+	setText("cache-ratio", lookups ? (100 * stats.cache_hits / lookups).toFixed(1) + "%" : "-");
+	setText("blocked", stats.blocked);
+	setText("connections", stats.connections);
+	setText("tunnels", stats.tunnels);
+	fillTop("top-clients", stats.top_clients);
+	fillTop("top-hosts", stats.top_hosts);
+}
+
+function fillTop(id, entries) {
+	const body = document.getElementById(id);
+	body.replaceChildren(...entries.map((e) => row([e.name, e.requests, bytes(e.bytes)])));
+}
+
+// drawThroughput plots the bytes sent to clients per second, scaled to the
+// highest sample
+function drawThroughput() {
+	const canvas = document.getElementById("throughput");
+	const context = canvas.getContext("2d");
+	const width = canvas.width;
+	const height = canvas.height;
+	context.clearRect(0, 0, width, height);
+	const max = Math.max(1, ...samples.map((s) => s.out));
+	const step = width / (SAMPLES - 1);
+	const x0 = width - (samples.length - 1) * step;
+	context.beginPath();
+	samples.forEach((s, i) => {
+		const x = x0 + i * step;
+		const y = height - 4 - (height - 8) * s.out / max;
+		if (i === 0) {
+			context.moveTo(x, y);
+		} else {
+			context.lineTo(x, y);
+		}
+	});
+	context.strokeStyle = "#2d6cdf";
+	context.lineWidth = 2;
+	context.stroke();
+	context.fillStyle = "#666";
+	context.fillText("peak " + bytes(max) + "/s", 8, 14);
+}
+
+function updateTunnels(connections) {
+	const body = document.getElementById("tunnels-list");
+	body.replaceChildren(...connections.map((c) => {
+		const kill = document.createElement("button");
+		kill.textContent = "Kill";
+		kill.onclick = async () => {
+			await action("/connections/kill?id=" + c.id, { method: "POST" });
+			refresh();
+		};
+		return row([c.id, c.peer, c.user, c.target, bytes(c.sent), bytes(c.received), since(c.started), kill]);
+	}));
+}
+
+function updateTail(recent) {
+	// The proxy restarted, start over
+	if (recent.last < lastSeq) {
+		lastSeq = 0;
+		document.getElementById("tail").replaceChildren();
+		return;
+	}
+	lastSeq = recent.last;
+	const body = document.getElementById("tail");
+	for (const r of recent.requests) {
+		const tr = row(
+			[new Date(r.time).toLocaleTimeString(), r.client, r.method, r.url, r.status, bytes(r.bytes), r.duration.toFixed(3) + "s", r.cache, r.decision],
+			[null, null, null, "url", "status"],
+		);
+		tr.title = r.url;
+		if (r.status >= 500) {
+			tr.className = "server-error";
+		} else if (r.status >= 400) {
+			tr.className = "client-error";
+		}
+		body.insertBefore(tr, body.firstChild);
+	}
+	while (body.children.length > TAIL_ROWS) {
+		body.removeChild(body.lastChild);
+	}
+}
+
+async function refresh() {
+	try {
+		const [stats, tunnels, recent] = await Promise.all([
+			get("/stats"),
+			get("/connections?kind=client&state=tunnel"),
+			get("/requests/recent?after=" + lastSeq),
+		]);
+		updateStats(stats);
+		updateTunnels(tunnels);
+		updateTail(recent);
+		setStatus(null);
+	} catch (error) {
+		setStatus(error);
+	}
+}
+
+function lines(text) {
+	return text.split("\n").map((line) => line.trim()).filter((line) => line !== "");
+}
+
+function showRules(policies) {
+	const container = document.getElementById("rules");
+	const template = document.getElementById("rules-template");
+	container.replaceChildren(...policies.map((p) => {
+		const form = template.content.firstElementChild.cloneNode(true);
+		form.querySelector(".name").textContent = p.policy === "" ? "Default policy" : "Policy " + p.policy;
+		form.classList.toggle("is-edited", p.edited);
+		form.hosts.value = (p.block.hosts || []).join("\n");
+		form.sites.value = (p.block.sites || []).join("\n");
+		form.redirect.value = Object.entries(p.redirect || {}).map(([from, to]) => from + " " + to).join("\n");
+		const error = form.querySelector(".error");
+		const send = async (init) => {
+			const response = await action("/rules?policy=" + encodeURIComponent(p.policy), init);
+			if (!response.ok) {
+				error.textContent = (await response.text()).trim();
+				return;
+			}
+			showRules(await response.json());
+		};
+		form.onsubmit = (event) => {
+			event.preventDefault();
+			const redirect = {};
+			for (const line of lines(form.redirect.value)) {
+				const [from, to] = line.split(/\s+/);
+				redirect[from] = to || "";
+			}
+			send({
+				method: "PUT",
+				headers: { "Content-Type": "application/json" },
+				body: JSON.stringify({
+					block: { hosts: lines(form.hosts.value), sites: lines(form.sites.value) },
+					redirect: redirect,
+				}),
+			});
+		};
+		form.querySelector(".reset").onclick = () => send({ method: "DELETE" });
+		return form;
+	}));
+}
+
+async function loadRules() {
+	try {
+		showRules(await get("/rules"));
+	} catch (error) {
+		setStatus(error);
+	}
+}
+
+refresh();
+loadRules();
+setInterval(refresh, INTERVAL * 1000);
@@ -0,0 +1,20 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/WangYihang/PrGoxy/lib/config"
+	"github.com/WangYihang/PrGoxy/lib/model"
+)
+
+// HandleLimits registers the connection limit endpoint
+//
+//	GET  /limits                current counts against the configured limits
+func (o *AdminServer) HandleLimits() {
+	o.Mux.HandleFunc("/limits", func(w http.ResponseWriter, r *http.Request) {
+		if !AllowMethods(w, r, "GET") {
+			return
+		}
+		WriteJSON(w, model.Admissions.Stats(&config.Get().Limits))
+	})
+}
@@ -0,0 +1,28 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/WangYihang/PrGoxy/lib/util/log"
+)
+
+// HandleLog registers the log endpoints
+//
+//	GET  /log/level             current level
+//	PUT  /log/level?level=      change the level until the config sets another
+func (o *AdminServer) HandleLog() {
+	o.Mux.HandleFunc("/log/level", func(w http.ResponseWriter, r *http.Request) {
+		if !AllowMethods(w, r, "GET", "PUT", "POST") {
+			return
+		}
+		if r.Method != "GET" {
+			err := log.SetLevel(r.URL.Query().Get("level"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Info("Log level set to %s by %s", log.Level(), r.RemoteAddr)
+		}
+		WriteJSON(w, map[string]string{"level": log.Level()})
+	})
+}
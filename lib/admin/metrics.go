@@ -0,0 +1,20 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/WangYihang/PrGoxy/lib/metrics"
+)
+
+// HandleMetrics registers the Prometheus endpoint
+//
+//	GET  /metrics               metrics in the Prometheus text format
+func (o *AdminServer) HandleMetrics() {
+	o.Mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if !AllowMethods(w, r, "GET") {
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.Write(w)
+	})
+}
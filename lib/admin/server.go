@@ -0,0 +1,172 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/WangYihang/PrGoxy/lib/config"
+	"github.com/WangYihang/PrGoxy/lib/model"
+	"github.com/WangYihang/PrGoxy/lib/upgrade"
+	"github.com/WangYihang/PrGoxy/lib/util/log"
+)
+
+type AdminServer struct {
+	Host       string
+	Port       int
+	Mux        *http.ServeMux
+	Proxies    []*model.TCPServer
+	HTTPServer *http.Server
+	Socket     net.Listener
+	// Closed on shutdown, ends the streams still open
+	Done      chan struct{}
+	closeDone *sync.Once
+}
+
+func CreateAdminServer(host string, port int, proxies []*model.TCPServer) *AdminServer {
+	server := &AdminServer{
+		Host:      host,
+		Port:      port,
+		Mux:       http.NewServeMux(),
+		Proxies:   proxies,
+		Done:      make(chan struct{}),
+		closeDone: new(sync.Once),
+	}
+	server.HTTPServer = &http.Server{
+		Addr:    server.ToString(),
+		Handler: server,
+	}
+	server.HandleCache()
+	server.HandlePrefetch()
+	server.HandleLimits()
+	server.HandleLog()
+	server.HandleMetrics()
+	server.HandleConnections()
+	server.HandleDashboard()
+	server.HandleRules()
+	server.HandleTail()
+	server.HandleCaptures()
+	return server
+}
+
+func (o *AdminServer) ToString() string {
+	return net.JoinHostPort(o.Host, strconv.Itoa(o.Port))
+}
+
+// ServeHTTP only lets clients in the admin allow list through, and rejects
+// cross site requests
+func (o *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !config.Get().Admin.Allowed(RemoteAddr(r.RemoteAddr)) {
+		log.Warn("Admin request from %s is not allowed", r.RemoteAddr)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !SameOrigin(r) {
+		log.Warn("Admin request from %s has a foreign origin %s", r.RemoteAddr, r.Header.Get("Origin"))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !Safe(r.Method) && !Scripted(r) {
+		log.Warn("Admin %s %s from %s is not scripted", r.Method, r.URL, r.RemoteAddr)
+		http.Error(w, "Forbidden, send X-Requested-With or a json body", http.StatusForbidden)
+		return
+	}
+	log.Debug("Admin %s %s from %s", r.Method, r.URL, r.RemoteAddr)
+	o.Mux.ServeHTTP(w, r)
+}
+
+// SameOrigin tells if a browser sent the request from a page of the admin
+// server itself. Requests without an Origin header aren't from a browser
+// script, or are same origin GETs.
+func SameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && strings.EqualFold(u.Host, r.Host)
+}
+
+// Safe tells if requests of the method don't change anything
+func Safe(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// Scripted tells if the request can't be a plain html form or a simple
+// cross site request: browsers only send a custom header or a json content
+// type from scripts of the same origin.
+func Scripted(r *http.Request) bool {
+	if r.Header.Get("X-Requested-With") != "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// Listen binds the admin socket, or takes it over from the process being
+// upgraded
+func (o *AdminServer) Listen() error {
+	listener, err := upgrade.Listen("admin", o.ToString())
+	if err != nil {
+		return err
+	}
+	o.Socket = listener
+	return nil
+}
+
+// Run serves the admin API until Shutdown, Listen must have been called
+func (o *AdminServer) Run() {
+	log.Info("Admin server running at: %s", o.ToString())
+	err := o.HTTPServer.Serve(o.Socket)
+	if err != nil && err != http.ErrServerClosed {
+		log.Error("Admin server failed: %s", err)
+	}
+}
+
+func (o *AdminServer) Shutdown(ctx context.Context) error {
+	o.closeDone.Do(func() {
+		close(o.Done)
+	})
+	return o.HTTPServer.Shutdown(ctx)
+}
+
+// RemoteAddr adapts http.Request.RemoteAddr to net.Addr
+type RemoteAddr string
+
+func (addr RemoteAddr) Network() string {
+	return "tcp"
+}
+
+func (addr RemoteAddr) String() string {
+	return string(addr)
+}
+
+func WriteJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	err := encoder.Encode(v)
+	if err != nil {
+		log.Error("Failed to encode admin response: %s", err)
+	}
+}
+
+// AllowMethods rejects requests whose method is not in the list
+func AllowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	return false
+}
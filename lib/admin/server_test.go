@@ -0,0 +1,36 @@
+package admin
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCrossSite(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		allowed bool
+	}{
+		{"get", "GET", nil, true},
+		{"get from the dashboard", "GET", map[string]string{"Origin": "http://admin.test:9091"}, true},
+		{"plain post", "POST", nil, false},
+		{"form post", "POST", map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, false},
+		{"scripted post", "POST", map[string]string{"X-Requested-With": "XMLHttpRequest"}, true},
+		{"json put", "PUT", map[string]string{"Content-Type": "application/json; charset=utf-8"}, true},
+		{"post from the dashboard", "POST", map[string]string{"Origin": "http://admin.test:9091", "X-Requested-With": "XMLHttpRequest"}, true},
+		{"post from another site", "POST", map[string]string{"Origin": "https://evil.test", "X-Requested-With": "XMLHttpRequest"}, false},
+		{"get from another port", "GET", map[string]string{"Origin": "http://admin.test:8080"}, false},
+		{"null origin", "DELETE", map[string]string{"Origin": "null", "X-Requested-With": "XMLHttpRequest"}, false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "http://admin.test:9091/cache/flush", nil)
+		for key, value := range test.headers {
+			r.Header.Set(key, value)
+		}
+		allowed := SameOrigin(r) && (Safe(r.Method) || Scripted(r))
+		if allowed != test.allowed {
+			t.Errorf("%s: allowed = %v, want %v", test.name, allowed, test.allowed)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/WangYihang/PrGoxy/lib/model"
+	"github.com/WangYihang/PrGoxy/lib/util/log"
+)
+
+// Seconds between keepalives on idle streams, so that proxies in between
+// don't time them out
+const keepaliveInterval = 15 * time.Second
+
+// HandleTail registers the live request stream, as Server-Sent Events or
+// WebSocket messages when the client asks to upgrade. Every message is the
+// json record of a finished request.
+//
+//	GET  /requests/tail?client=&host=&status=&method=&after=SEQ
+//
+// With after, or Last-Event-ID when an event source reconnects, the recent
+// requests newer than SEQ are sent first.
+func (o *AdminServer) HandleTail() {
+	o.Mux.HandleFunc("/requests/tail", func(w http.ResponseWriter, r *http.Request) {
+		if !AllowMethods(w, r, "GET") {
+			return
+		}
+		filter, err := model.CreateRequestFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		after := r.URL.Query().Get("after")
+		if after == "" {
+			after = r.Header.Get("Last-Event-ID")
+		}
+		seq, err := strconv.ParseUint(after, 10, 64)
+		backlog := err == nil
+		if after != "" && !backlog {
+			http.Error(w, "Invalid after", http.StatusBadRequest)
+			return
+		}
+		if IsWebSocket(r) {
+			o.TailWebSocket(w, r, filter, backlog, seq)
+		} else {
+			o.TailEvents(w, r, filter, backlog, seq)
+		}
+	})
+}
+
+// TailEvents streams records as Server-Sent Events, with their seq as id
+func (o *AdminServer) TailEvents(w http.ResponseWriter, r *http.Request, filter *model.RequestFilter, backlog bool, after uint64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	log.Debug("Request tail opened by %s", r.RemoteAddr)
+	o.stream(filter, backlog, after, r.Context().Done(), func(record *model.RecentRecord, data []byte) error {
+		_, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", record.Seq, data)
+		flusher.Flush()
+		return err
+	}, func() error {
+		_, err := fmt.Fprint(w, ": keepalive\n\n")
+		flusher.Flush()
+		return err
+	})
+}
+
+// TailWebSocket streams records as WebSocket text messages
+func (o *AdminServer) TailWebSocket(w http.ResponseWriter, r *http.Request, filter *model.RequestFilter, backlog bool, after uint64) {
+	ws, err := UpgradeWebSocket(w, r)
+	if err != nil {
+		log.Warn("WebSocket upgrade from %s failed: %s", r.RemoteAddr, err)
+		return
+	}
+	defer ws.Close(CloseGoingAway)
+	log.Debug("Request tail opened by %s over WebSocket", r.RemoteAddr)
+	o.stream(filter, backlog, after, ws.Closed, func(record *model.RecentRecord, data []byte) error {
+		return ws.WriteText(data)
+	}, ws.Ping)
+}
+
+// stream sends the matching records until the client goes away, send fails
+// or the admin server shuts down
+func (o *AdminServer) stream(filter *model.RequestFilter, backlog bool, after uint64, gone <-chan struct{}, send func(*model.RecentRecord, []byte) error, keepalive func() error) {
+	subscription, records := model.Recent.Subscribe(filter, backlog, after)
+	defer model.Recent.Unsubscribe(subscription)
+	write := func(record *model.RecentRecord) error {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return send(record, data)
+	}
+	for i := range records {
+		if write(&records[i]) != nil {
+			return
+		}
+	}
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case record := <-subscription.Records:
+			if write(&record) != nil {
+				return
+			}
+		case <-ticker.C:
+			if keepalive() != nil {
+				return
+			}
+		case <-gone:
+			return
+		case <-o.Done:
+			return
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package admin
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Frame opcodes of RFC 6455
+const (
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+	opPong  = 0xa
+)
+
+// Close status codes of RFC 6455
+const (
+	CloseGoingAway     = 1001
+	CloseProtocolError = 1002
+)
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// errUnmasked is returned for client frames without a mask, RFC 6455 5.1
+// requires the server to close the connection
+var errUnmasked = fmt.Errorf("WebSocket frame from client is not masked")
+
+// Largest frame read from clients, they are only expected to send control
+// frames
+const maxFrameSize = 1 << 16
+
+// WebSocket is the server side of a WebSocket connection that only sends
+// text messages. Pings and close frames from the client are answered, other
+// messages are ignored.
+type WebSocket struct {
+	Conn   net.Conn
+	Reader *bufio.Reader
+	// Guards writes, control frames are answered from the reading goroutine
+	Lock *sync.Mutex
+	// Closed once the client is gone or has closed the connection
+	Closed chan struct{}
+}
+
+// IsWebSocket tells whether the request asks to switch to WebSocket
+func IsWebSocket(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range strings.Split(r.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// UpgradeWebSocket completes the opening handshake and takes the connection
+// over from the http server, the error is already answered when not nil
+func UpgradeWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocket, error) {
+	// Browsers let any site open a WebSocket, only the origin tells them apart
+	if !SameOrigin(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, fmt.Errorf("WebSocket from a foreign origin %s", r.Header.Get("Origin"))
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("Unsupported WebSocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, fmt.Errorf("Missing Sec-WebSocket-Key")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("Connection can not be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	_, err = fmt.Fprintf(
+		conn,
+		"HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]),
+	)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ws := &WebSocket{
+		Conn:   conn,
+		Reader: rw.Reader,
+		Lock:   new(sync.Mutex),
+		Closed: make(chan struct{}),
+	}
+	go ws.read()
+	return ws, nil
+}
+
+func (o *WebSocket) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	n := len(payload)
+	switch {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xffff:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	o.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := o.Conn.Write(append(header, payload...))
+	return err
+}
+
+func (o *WebSocket) WriteText(data []byte) error {
+	return o.writeFrame(opText, data)
+}
+
+func (o *WebSocket) Ping() error {
+	return o.writeFrame(opPing, nil)
+}
+
+// Close sends a close frame with the status code and closes the connection
+// without waiting for the client to answer
+func (o *WebSocket) Close(code uint16) {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, code)
+	o.writeFrame(opClose, payload)
+	o.Conn.Close()
+}
+
+// read answers control frames until the connection ends
+func (o *WebSocket) read() {
+	defer close(o.Closed)
+	for {
+		opcode, payload, err := o.readFrame()
+		if err == errUnmasked {
+			o.Close(CloseProtocolError)
+			return
+		}
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case opPing:
+			o.writeFrame(opPong, payload)
+		case opClose:
+			// Echo the status code
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			o.writeFrame(opClose, payload)
+			o.Conn.Close()
+			return
+		}
+	}
+}
+
+func (o *WebSocket) readFrame() (byte, []byte, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(o.Reader, header)
+	if err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0f
+	if header[1]&0x80 == 0 {
+		return 0, nil, errUnmasked
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(o.Reader, extended); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(o.Reader, extended); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if length > maxFrameSize {
+		return 0, nil, fmt.Errorf("WebSocket frame too large: %d", length)
+	}
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(o.Reader, mask); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(o.Reader, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
@@ -0,0 +1,25 @@
+package config
+
+import "fmt"
+
+const (
+	AccessLogCommon   = "common"
+	AccessLogCombined = "combined"
+	AccessLogJSON     = "json"
+)
+
+// AccessLog records one line per request
+type AccessLog struct {
+	// File to append to, - for stdout, the access log is off if unset
+	Path string `json:"path"`
+	// common, combined or json, combined if unset
+	Format string `json:"format"`
+}
+
+func (accessLog *AccessLog) Validate() error {
+	switch accessLog.Format {
+	case "", AccessLogCommon, AccessLogCombined, AccessLogJSON:
+		return nil
+	}
+	return fmt.Errorf("Invalid access log format: %q", accessLog.Format)
+}
@@ -1,42 +1,244 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
-	"os"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
 
+	"github.com/WangYihang/PrGoxy/lib/metrics"
 	"github.com/WangYihang/PrGoxy/lib/util/log"
 )
 
+type Admin struct {
+	LHost string `json:"lhost"`
+	LPort int    `json:"lport"`
+	// Client IPs allowed to use the admin API and the PURGE method
+	Allow []string `json:"allow"`
+}
+
 type Config struct {
+	// Single listener, used when no listeners are configured
 	Proxy struct {
 		LHost string `json:"lhost"`
-		LPort int16  `json:"lport"`
+		LPort int    `json:"lport"`
 	} `json:"proxy"`
-	Block struct {
-		Hosts []string `hosts:"redirect"`
-		Sites []string `sites:"redirect"`
-	} `json:"block"`
-	Redirect map[string]string `json:"redirect"`
-	Cache    bool              `json:cache`
+	Listeners []Listener `json:"listeners"`
+	// Top level block, redirect, cache and auth form the default policy
+	Policy
+	Policies map[string]Policy `json:"policies"`
+	// Seconds a stale cached response may still be served, used when the
+	// response itself carries no stale-* Cache-Control directive
+	Stale struct {
+		WhileRevalidate int `json:"while_revalidate"`
+		IfError         int `json:"if_error"`
+	} `json:"stale"`
+	Admin     Admin        `json:"admin"`
+	Timeouts  Timeouts     `json:"timeouts"`
+	Limits    Limits       `json:"limits"`
+	AccessLog AccessLog    `json:"access_log"`
+	Log       log.Settings `json:"log"`
+	Replay    Replay       `json:"replay"`
+	Tracing   Tracing      `json:"tracing"`
+	// Tell clients how long each phase of their request took in a
+	// Server-Timing header
+	ServerTiming bool `json:"server_timing"`
+	// Seconds to wait for clients to finish on shutdown, 30 if unset
+	ShutdownTimeout int `json:"shutdown_timeout"`
+	// Config file and the files it includes
+	Files []string `json:"-"`
 }
 
-var Cfg Config
+var Reloads = metrics.CreateCounter(
+	"prgoxy_config_reloads_total",
+	"Config loads, by result: success or failure",
+	"result",
+)
+
+// Path of the config file
+var Path = "config.json"
+
+// current holds the *Config in use, it is replaced as a whole on reload and
+// never modified in place, so readers always see one consistent snapshot
+var current atomic.Value
+
+// empty is in use until the first config is loaded
+var empty = &Config{}
 
 func init() {
-	log.Info("Loading config")
-	Cfg.Reload()
+	current.Store(empty)
+}
+
+// Get returns the current config snapshot, callers must not modify it
+func Get() *Config {
+	return current.Load().(*Config)
+}
+
+// Load parses a config file and its includes into a fresh Config, the
+// format is chosen by extension: .json, .yaml, .yml or .toml
+func Load(path string) (*Config, error) {
+	var files []string
+	tree, err := loadTree(path, make(map[string]bool), &files)
+	if err != nil {
+		return nil, err
+	}
+	// Decode the merged tree through json so every format shares the same
+	// field names, unknown fields are rejected to catch typos
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse config file: %s", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	config := &Config{}
+	err = decoder.Decode(config)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse config file: %s", err)
+	}
+	config.Files = files
+	return config, nil
+}
+
+// Validate checks the whole config, the first problem found is returned
+func (config *Config) Validate() error {
+	if config.Admin.LPort < 0 || config.Admin.LPort > 65535 {
+		return fmt.Errorf("Invalid admin port: %d", config.Admin.LPort)
+	}
+	for _, v := range config.Admin.Allow {
+		if net.ParseIP(v) == nil {
+			return fmt.Errorf("Invalid admin allowed IP: %q", v)
+		}
+	}
+	err := config.Policy.Validate()
+	if err != nil {
+		return err
+	}
+	for name, policy := range config.Policies {
+		err := policy.Validate()
+		if err != nil {
+			return fmt.Errorf("Policy %s: %s", name, err)
+		}
+	}
+	names := make(map[string]bool)
+	for _, listener := range config.ListenerList() {
+		if names[listener.Name] {
+			return fmt.Errorf("Duplicate listener name: %q", listener.Name)
+		}
+		names[listener.Name] = true
+		err := listener.Validate(config)
+		if err != nil {
+			return fmt.Errorf("Listener %s: %s", listener.Name, err)
+		}
+	}
+	if config.ShutdownTimeout < 0 {
+		return fmt.Errorf("Invalid shutdown timeout: %d", config.ShutdownTimeout)
+	}
+	if config.Stale.WhileRevalidate < 0 || config.Stale.IfError < 0 {
+		return fmt.Errorf("Invalid stale window: %+v", config.Stale)
+	}
+	err = config.Timeouts.Validate()
+	if err != nil {
+		return err
+	}
+	err = config.Limits.Validate()
+	if err != nil {
+		return err
+	}
+	err = config.AccessLog.Validate()
+	if err != nil {
+		return err
+	}
+	err = config.Log.Validate()
+	if err != nil {
+		return err
+	}
+	err = config.Replay.Validate()
+	if err != nil {
+		return err
+	}
+	err = config.Tracing.Validate()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateHostPort accepts host or host:port, the form used by redirects
+func validateHostPort(hostport string) error {
+	host := hostport
+	if strings.Contains(hostport, ":") {
+		var port string
+		var err error
+		host, port, err = net.SplitHostPort(hostport)
+		if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(port)
+		if err != nil || n <= 0 || n > 65535 {
+			return fmt.Errorf("port out of range")
+		}
+	}
+	if host == "" || strings.ContainsAny(host, "/ ") {
+		return fmt.Errorf("bad host")
+	}
+	return nil
 }
 
-func (config *Config) Reload() {
-	// Open config file
-	file, err := os.Open("config.json")
-	defer file.Close()
+// Check loads the config file with overrides applied and validates it
+func Check() (*Config, error) {
+	config, err := Load(Path)
 	if err != nil {
-		log.Error("Can not open config file")
+		return nil, err
 	}
-	// Parse content
-	err = json.NewDecoder(file).Decode(config)
+	err = Override.Apply(config)
 	if err != nil {
-		log.Error("Failed to parse config file: %s", err)
+		return nil, err
+	}
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Reload loads and validates the config file, then swaps it in. The config
+// in use is kept if anything goes wrong.
+func Reload() error {
+	updating.Lock()
+	defer updating.Unlock()
+	config, err := Check()
+	if err == nil {
+		// Outputs that can't be opened reject the config too
+		err = log.Configure(config.Log)
+	}
+	if err != nil {
+		Reloads.Inc("failure")
+		return err
+	}
+	Reloads.Inc("success")
+	previous := Get()
+	current.Store(config)
+	if previous == empty {
+		return nil
+	}
+	for _, line := range Diff(previous, config) {
+		log.Info("Config changed: %s", line)
+	}
+	return nil
+}
+
+func (admin *Admin) Allowed(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	for _, v := range admin.Allow {
+		if host == v {
+			return true
+		}
 	}
+	return false
 }
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Diff describes what changed between two configs, one line per changed
+// setting, e.g.
+//
+//	proxy.lport: 8080 => 9090
+//	block.sites: + google.com
+//
+// Passwords are masked, only the user whose password changed is named.
+func Diff(previous *Config, config *Config) []string {
+	before := flatten(previous)
+	after := flatten(config)
+	keys := make(map[string]bool)
+	for k := range before {
+		keys[k] = true
+	}
+	for k := range after {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var lines []string
+	for _, k := range sorted {
+		b, inBefore := before[k]
+		a, inAfter := after[k]
+		// List items are keyed by setting and value, show the setting only
+		name := k
+		if index := strings.Index(k, listItem); index >= 0 {
+			name = k[:index]
+		}
+		if secretSetting.MatchString(name) {
+			b, a = maskSecret(b), maskSecret(a)
+			if inBefore && inAfter && before[k] != after[k] {
+				lines = append(lines, fmt.Sprintf("%s: changed", name))
+				continue
+			}
+		}
+		switch {
+		case !inBefore:
+			lines = append(lines, fmt.Sprintf("%s: + %s", name, a))
+		case !inAfter:
+			lines = append(lines, fmt.Sprintf("%s: - %s", name, b))
+		case a != b:
+			lines = append(lines, fmt.Sprintf("%s: %s => %s", name, b, a))
+		}
+	}
+	return lines
+}
+
+const listItem = "\x00"
+
+// Settings whose values must not be logged, the passwords of users of the
+// default policy and of named policies
+var secretSetting = regexp.MustCompile(`^(policies\..+\.)?auth\.`)
+
+func maskSecret(value string) string {
+	if value == "" {
+		return value
+	}
+	return `"***"`
+}
+
+// flatten turns a config into setting => value pairs, list items become
+// their own keys so that adding one item shows up as one line
+func flatten(config *Config) map[string]string {
+	settings := make(map[string]string)
+	data, err := json.Marshal(config)
+	if err != nil {
+		return settings
+	}
+	var tree interface{}
+	err = json.Unmarshal(data, &tree)
+	if err != nil {
+		return settings
+	}
+	flattenInto(settings, "", tree)
+	return settings
+}
+
+func flattenInto(settings map[string]string, prefix string, node interface{}) {
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "." + key
+	}
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			flattenInto(settings, join(key), child)
+		}
+	case []interface{}:
+		for _, child := range v {
+			data, _ := json.Marshal(child)
+			settings[prefix+listItem+string(data)] = string(data)
+		}
+	case nil:
+		// Unset lists and maps
+	default:
+		data, _ := json.Marshal(v)
+		settings[prefix] = string(data)
+	}
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name   string
+		before func(*Config)
+		after  func(*Config)
+		want   []string
+	}{
+		{
+			name:   "unchanged",
+			before: func(c *Config) {},
+			after:  func(c *Config) {},
+			want:   nil,
+		},
+		{
+			name:   "setting changed",
+			before: func(c *Config) { c.Proxy.LPort = 8080 },
+			after:  func(c *Config) { c.Proxy.LPort = 9090 },
+			want:   []string{"proxy.lport: 8080 => 9090"},
+		},
+		{
+			name:   "list item added and removed",
+			before: func(c *Config) { c.Block.Sites = []string{"a.test", "b.test"} },
+			after:  func(c *Config) { c.Block.Sites = []string{"b.test", "c.test"} },
+			want: []string{
+				`block.sites: - "a.test"`,
+				`block.sites: + "c.test"`,
+			},
+		},
+		{
+			name:   "user added",
+			before: func(c *Config) {},
+			after:  func(c *Config) { c.Auth = map[string]string{"alice": "s3cret"} },
+			want:   []string{`auth.alice: + "***"`},
+		},
+		{
+			name:   "password changed",
+			before: func(c *Config) { c.Auth = map[string]string{"alice": "old"} },
+			after:  func(c *Config) { c.Auth = map[string]string{"alice": "s3cret"} },
+			want:   []string{"auth.alice: changed"},
+		},
+		{
+			name: "user of a named policy removed",
+			before: func(c *Config) {
+				c.Policies = map[string]Policy{"guest": {Auth: map[string]string{"bob": "hunter2"}}}
+			},
+			after: func(c *Config) {
+				c.Policies = map[string]Policy{"guest": {}}
+			},
+			want: []string{`policies.guest.auth.bob: - "***"`},
+		},
+	}
+	for _, test := range tests {
+		before, after := new(Config), new(Config)
+		test.before(before)
+		test.after(after)
+		got := Diff(before, after)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: Diff = %q, want %q", test.name, got, test.want)
+		}
+		for _, line := range got {
+			for _, password := range []string{"s3cret", "old", "hunter2"} {
+				if strings.Contains(line, password) {
+					t.Errorf("%s: password leaked in %q", test.name, line)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Decoders parse a config file into a generic tree, chosen by extension.
+// Every format shares the json field names of Config.
+var Decoders = map[string]func(data []byte, tree *map[string]interface{}) error{
+	".json": func(data []byte, tree *map[string]interface{}) error {
+		return json.Unmarshal(data, tree)
+	},
+	".yaml": func(data []byte, tree *map[string]interface{}) error {
+		return yaml.Unmarshal(data, tree)
+	},
+	".yml": func(data []byte, tree *map[string]interface{}) error {
+		return yaml.Unmarshal(data, tree)
+	},
+	".toml": func(data []byte, tree *map[string]interface{}) error {
+		return toml.Unmarshal(data, tree)
+	},
+}
+
+// loadTree reads a config file and the files it includes. Included files are
+// loaded first and the including file is merged on top of them, paths are
+// relative to the including file.
+// Every file read is appended to files.
+func loadTree(path string, loading map[string]bool, files *[]string) (map[string]interface{}, error) {
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if loading[absolute] {
+		return nil, fmt.Errorf("%s is included recursively", path)
+	}
+	loading[absolute] = true
+	defer delete(loading, absolute)
+	*files = append(*files, absolute)
+
+	decode, ok := Decoders[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		return nil, fmt.Errorf("Unknown config format: %s", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can not open config file: %s", err)
+	}
+	tree := make(map[string]interface{})
+	err = decode(data, &tree)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse config file %s: %s", path, err)
+	}
+	normalize(tree)
+
+	includes, err := includeList(tree["include"])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	delete(tree, "include")
+	merged := make(map[string]interface{})
+	for _, include := range includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		included, err := loadTree(include, loading, files)
+		if err != nil {
+			return nil, err
+		}
+		merge(merged, included)
+	}
+	merge(merged, tree)
+	return merged, nil
+}
+
+// include may be a single path or a list of paths
+func includeList(include interface{}) ([]string, error) {
+	switch v := include.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		includes := make([]string, 0, len(v))
+		for _, item := range v {
+			path, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("Invalid include: %v", item)
+			}
+			includes = append(includes, path)
+		}
+		return includes, nil
+	}
+	return nil, fmt.Errorf("Invalid include: %v", include)
+}
+
+// normalize turns the arrays of tables TOML decodes as []map[string]interface{}
+// into plain lists, so that lists merge alike in every format
+func normalize(node interface{}) interface{} {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = normalize(child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = normalize(child)
+		}
+	case []map[string]interface{}:
+		list := make([]interface{}, len(v))
+		for i, child := range v {
+			list[i] = normalize(child)
+		}
+		return list
+	}
+	return node
+}
+
+// merge copies src into dst, maps are merged recursively, lists are
+// concatenated and any other value in src replaces the one in dst
+func merge(dst map[string]interface{}, src map[string]interface{}) {
+	for k, v := range src {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if d, ok := dst[k].(map[string]interface{}); ok {
+				merge(d, v)
+				continue
+			}
+		case []interface{}:
+			if d, ok := dst[k].([]interface{}); ok {
+				dst[k] = append(d, v...)
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Included lists are concatenated whatever the format, arrays of tables too
+func TestLoadIncludeMergesLists(t *testing.T) {
+	files := map[string]map[string]string{
+		".toml": {
+			"main": `include = "more.toml"
+[block]
+sites = ["a.test"]
+[[listeners]]
+name = "a"
+lport = 8080
+`,
+			"more": `[block]
+sites = ["b.test"]
+[[listeners]]
+name = "b"
+lport = 8081
+`,
+		},
+		".yaml": {
+			"main": `include: more.yaml
+block:
+  sites: [a.test]
+listeners:
+  - name: a
+    lport: 8080
+`,
+			"more": `block:
+  sites: [b.test]
+listeners:
+  - name: b
+    lport: 8081
+`,
+		},
+		".json": {
+			"main": `{"include":"more.json","block":{"sites":["a.test"]},"listeners":[{"name":"a","lport":8080}]}`,
+			"more": `{"block":{"sites":["b.test"]},"listeners":[{"name":"b","lport":8081}]}`,
+		},
+	}
+	for ext, contents := range files {
+		dir := t.TempDir()
+		for name, content := range contents {
+			err := os.WriteFile(filepath.Join(dir, name+ext), []byte(content), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		config, err := Load(filepath.Join(dir, "main"+ext))
+		if err != nil {
+			t.Errorf("%s: %s", ext, err)
+			continue
+		}
+		var names []string
+		for _, listener := range config.Listeners {
+			names = append(names, listener.Name)
+		}
+		// Included files come first
+		if want := []string{"b", "a"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("%s: listeners = %v, want %v", ext, names, want)
+		}
+		if want := []string{"b.test", "a.test"}; !reflect.DeepEqual(config.Block.Sites, want) {
+			t.Errorf("%s: block.sites = %v, want %v", ext, config.Block.Sites, want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// Connections over a limit are answered with 503 at once
+	QueueReject = "reject"
+	// Connections over a limit wait up to queue_timeout for a slot
+	QueueWait = "wait"
+)
+
+// Limits on concurrent connections, zero means unlimited
+type Limits struct {
+	// Client connections over all listeners
+	MaxConnections int `json:"max_connections"`
+	// Client connections from one IP
+	PerClient int `json:"per_client"`
+	// Upstream connections to one host
+	PerHost int `json:"per_host"`
+	// reject or wait, reject if unset
+	Queue string `json:"queue"`
+	// Seconds a connection may wait for a slot, 30 if unset
+	QueueTimeout int `json:"queue_timeout"`
+}
+
+const DefaultQueueTimeout = 30 * time.Second
+
+func (limits *Limits) Wait() bool {
+	return limits.Queue == QueueWait
+}
+
+// QueueTimeoutDuration is how long to wait for a slot, zero when over limit
+// connections are rejected
+func (limits *Limits) QueueTimeoutDuration() time.Duration {
+	if !limits.Wait() {
+		return 0
+	}
+	return seconds(limits.QueueTimeout, DefaultQueueTimeout)
+}
+
+func (limits *Limits) Validate() error {
+	if limits.MaxConnections < 0 || limits.PerClient < 0 || limits.PerHost < 0 || limits.QueueTimeout < 0 {
+		return fmt.Errorf("Invalid limits: %+v", *limits)
+	}
+	switch limits.Queue {
+	case "", QueueReject, QueueWait:
+	default:
+		return fmt.Errorf("Invalid queue strategy: %q", limits.Queue)
+	}
+	return nil
+}
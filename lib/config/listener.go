@@ -0,0 +1,179 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	ProtocolHTTP    = "http"
+	ProtocolSOCKS   = "socks"
+	ProtocolReverse = "reverse"
+)
+
+type Listener struct {
+	Name  string `json:"name"`
+	LHost string `json:"lhost"`
+	LPort int    `json:"lport"`
+	// http (default), socks or reverse
+	Protocol string `json:"protocol"`
+	// host:port every request is sent to, reverse only
+	Upstream string `json:"upstream"`
+	TLS      *TLS   `json:"tls"`
+	// Name of a policy in policies, empty for the default policy
+	Policy string `json:"policy"`
+}
+
+type TLS struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// CA bundle client certificates are verified against, none asked if empty
+	ClientCA string `json:"client_ca"`
+	// require (default) or optional, whether clients must send a certificate
+	ClientAuth string `json:"client_auth"`
+}
+
+// Policy is the set of rules applied to the clients of a listener
+type Policy struct {
+	Block    Block             `json:"block"`
+	Redirect map[string]string `json:"redirect"`
+	Cache    bool              `json:"cache"`
+	// user => password, clients must authenticate when not empty
+	Auth map[string]string `json:"auth"`
+}
+
+type Block struct {
+	// Client addresses, matched as prefixes of ip:port
+	Hosts []string `json:"hosts"`
+	// Hostnames of websites
+	Sites []string `json:"sites"`
+}
+
+// ListenerList returns the configured listeners, or a single http listener
+// built from proxy when there are none
+func (config *Config) ListenerList() []Listener {
+	if len(config.Listeners) > 0 {
+		return config.Listeners
+	}
+	return []Listener{
+		{
+			Name:     "default",
+			LHost:    config.Proxy.LHost,
+			LPort:    config.Proxy.LPort,
+			Protocol: ProtocolHTTP,
+		},
+	}
+}
+
+// PolicyOf returns the policy attached to the named listener
+func (config *Config) PolicyOf(listener string) *Policy {
+	for _, v := range config.ListenerList() {
+		if v.Name != listener || v.Policy == "" {
+			continue
+		}
+		if policy, ok := config.Policies[v.Policy]; ok {
+			return &policy
+		}
+	}
+	return &config.Policy
+}
+
+func (listener *Listener) Address() string {
+	return net.JoinHostPort(listener.LHost, fmt.Sprint(listener.LPort))
+}
+
+func (listener *Listener) Validate(config *Config) error {
+	if listener.Name == "" {
+		return fmt.Errorf("Listener name is required")
+	}
+	if listener.LHost != "" && net.ParseIP(listener.LHost) == nil {
+		return fmt.Errorf("Invalid bind address: %q", listener.LHost)
+	}
+	if listener.LPort <= 0 || listener.LPort > 65535 {
+		return fmt.Errorf("Invalid port: %d", listener.LPort)
+	}
+	switch listener.Protocol {
+	case "", ProtocolHTTP, ProtocolSOCKS:
+	case ProtocolReverse:
+		if err := validateHostPort(listener.Upstream); err != nil {
+			return fmt.Errorf("Invalid upstream %q: %s", listener.Upstream, err)
+		}
+	default:
+		return fmt.Errorf("Unknown protocol: %q", listener.Protocol)
+	}
+	if listener.TLS != nil {
+		if listener.TLS.Cert == "" || listener.TLS.Key == "" {
+			return fmt.Errorf("TLS needs both cert and key")
+		}
+		switch listener.TLS.ClientAuth {
+		case "", "require", "optional":
+		default:
+			return fmt.Errorf("Unknown TLS client_auth: %q", listener.TLS.ClientAuth)
+		}
+	}
+	if _, ok := config.Policies[listener.Policy]; listener.Policy != "" && !ok {
+		return fmt.Errorf("Unknown policy: %q", listener.Policy)
+	}
+	return nil
+}
+
+func (policy *Policy) Validate() error {
+	for _, v := range policy.Block.Sites {
+		if v == "" || strings.ContainsAny(v, "/: ") {
+			return fmt.Errorf("Invalid blocked site: %q", v)
+		}
+	}
+	for k, v := range policy.Redirect {
+		if err := validateHostPort(k); err != nil {
+			return fmt.Errorf("Invalid redirect source %q: %s", k, err)
+		}
+		if err := validateHostPort(v); err != nil {
+			return fmt.Errorf("Invalid redirect target %q: %s", v, err)
+		}
+	}
+	for user := range policy.Auth {
+		if user == "" || strings.Contains(user, ":") {
+			return fmt.Errorf("Invalid user: %q", user)
+		}
+	}
+	return nil
+}
+
+// HasUser tells whether a user may use the policy, any user may when the
+// policy has none
+func (policy *Policy) HasUser(user string) bool {
+	if len(policy.Auth) == 0 {
+		return true
+	}
+	_, ok := policy.Auth[user]
+	return ok
+}
+
+// Authenticate checks a user against the policy, any user is accepted when
+// the policy has no users
+func (policy *Policy) Authenticate(user string, password string) bool {
+	if len(policy.Auth) == 0 {
+		return true
+	}
+	expected, ok := policy.Auth[user]
+	return ok && expected == password
+}
+
+// ParseBasicAuth decodes the credentials of a Basic Authorization header
+func ParseBasicAuth(header string) (user string, password string, ok bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[len(prefix):]))
+	if err != nil {
+		return "", "", false
+	}
+	pair := strings.SplitN(string(decoded), ":", 2)
+	if len(pair) != 2 {
+		return "", "", false
+	}
+	return pair[0], pair[1], true
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Overrides are settings given on the command line or in the environment,
+// they win over the config file and are applied again on every reload
+type Overrides struct {
+	// host:port the proxy listens on
+	Listen string
+	// "true" or "false", empty keeps the config file setting
+	Cache string
+	// Log level, empty keeps the config file setting
+	LogLevel string
+	// Archive to record to or replay from, empty keeps the config file
+	// setting
+	Record string
+	Replay string
+	// Rules set from the admin API by policy name, "" for the default policy
+	Rules map[string]Rules
+}
+
+var Override Overrides
+
+func (o *Overrides) Apply(config *Config) error {
+	if o.Listen != "" {
+		host, portString, err := net.SplitHostPort(o.Listen)
+		if err != nil {
+			return fmt.Errorf("Invalid listen address %q: %s", o.Listen, err)
+		}
+		port, err := strconv.Atoi(portString)
+		if err != nil {
+			return fmt.Errorf("Invalid listen port %q: %s", portString, err)
+		}
+		// Replaces the first listener when several are configured
+		if len(config.Listeners) > 0 {
+			config.Listeners[0].LHost = host
+			config.Listeners[0].LPort = port
+		} else {
+			config.Proxy.LHost = host
+			config.Proxy.LPort = port
+		}
+	}
+	if o.Cache != "" {
+		cache, err := strconv.ParseBool(o.Cache)
+		if err != nil {
+			return fmt.Errorf("Invalid cache setting %q: %s", o.Cache, err)
+		}
+		config.Cache = cache
+		for name, policy := range config.Policies {
+			policy.Cache = cache
+			config.Policies[name] = policy
+		}
+	}
+	if o.LogLevel != "" {
+		config.Log.Level = o.LogLevel
+	}
+	if o.Record != "" && o.Replay != "" {
+		return fmt.Errorf("Can not record and replay at once")
+	}
+	if o.Record != "" {
+		config.Replay.Mode = ReplayRecord
+		config.Replay.Archive = o.Record
+	}
+	if o.Replay != "" {
+		config.Replay.Mode = ReplayReplay
+		config.Replay.Archive = o.Replay
+	}
+	for name, rules := range o.Rules {
+		// Edits to a policy removed from the config file are kept in case
+		// it comes back
+		rules.applyTo(config, name)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package config
+
+import "fmt"
+
+const (
+	ReplayRecord = "record"
+	ReplayReplay = "replay"
+
+	ReplayUnmatchedFail = "fail"
+	ReplayUnmatchedPass = "pass"
+)
+
+// Replay records the exchanges of the proxy handler to an archive, or answers
+// requests from it without touching the network
+type Replay struct {
+	// record or replay, neither if unset
+	Mode string `json:"mode"`
+	// JSON lines file, appended to when recording
+	Archive string `json:"archive"`
+	// Requests match on method and url, and on a hash of the body if set
+	MatchBody bool `json:"match_body"`
+	// What replay does with requests not in the archive, fail (default)
+	// with 502 or pass them through
+	Unmatched string `json:"unmatched"`
+}
+
+func (replay *Replay) Validate() error {
+	switch replay.Mode {
+	case "":
+		return nil
+	case ReplayRecord, ReplayReplay:
+	default:
+		return fmt.Errorf("Invalid replay mode: %q", replay.Mode)
+	}
+	if replay.Archive == "" {
+		return fmt.Errorf("Replay archive is required in %s mode", replay.Mode)
+	}
+	switch replay.Unmatched {
+	case "", ReplayUnmatchedFail, ReplayUnmatchedPass:
+		return nil
+	}
+	return fmt.Errorf("Invalid replay unmatched setting: %q", replay.Unmatched)
+}
+
+// Replaying tells whether requests are answered from the archive
+func (replay *Replay) Replaying() bool {
+	return replay.Mode == ReplayReplay
+}
+
+// Passes tells whether replay lets unmatched requests through
+func (replay *Replay) Passes() bool {
+	return replay.Unmatched == ReplayUnmatchedPass
+}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/WangYihang/PrGoxy/lib/util/log"
+)
+
+// Rules are the block and redirect rules of a policy, the part of it that
+// can be edited at runtime
+type Rules struct {
+	Block    Block             `json:"block"`
+	Redirect map[string]string `json:"redirect"`
+}
+
+// updating serializes the changes to the config in use, so that a reload
+// can't drop rules edited while the file was being read
+var updating = new(sync.Mutex)
+
+func (rules *Rules) applyTo(config *Config, name string) error {
+	if name == "" {
+		config.Policy.Block = rules.Block
+		config.Policy.Redirect = rules.Redirect
+		return nil
+	}
+	policy, ok := config.Policies[name]
+	if !ok {
+		return fmt.Errorf("Unknown policy: %q", name)
+	}
+	policy.Block = rules.Block
+	policy.Redirect = rules.Redirect
+	config.Policies[name] = policy
+	return nil
+}
+
+// RulesOf returns the rules of the named policy, the default policy if name
+// is empty
+func (config *Config) RulesOf(name string) (Rules, bool) {
+	policy := config.Policy
+	if name != "" {
+		var ok bool
+		policy, ok = config.Policies[name]
+		if !ok {
+			return Rules{}, false
+		}
+	}
+	return Rules{
+		Block:    policy.Block,
+		Redirect: policy.Redirect,
+	}, true
+}
+
+// clone copies the config deep enough to replace the rules of a policy
+func (config *Config) clone() *Config {
+	c := *config
+	c.Policies = make(map[string]Policy, len(config.Policies))
+	for k, v := range config.Policies {
+		c.Policies[k] = v
+	}
+	return &c
+}
+
+// SetRules replaces the rules of the named policy in the config in use. They
+// win over the config file until ResetRules or a restart.
+func SetRules(name string, rules Rules) error {
+	updating.Lock()
+	defer updating.Unlock()
+	previous := Get()
+	config := previous.clone()
+	err := rules.applyTo(config, name)
+	if err != nil {
+		return err
+	}
+	err = config.Validate()
+	if err != nil {
+		return err
+	}
+	if Override.Rules == nil {
+		Override.Rules = make(map[string]Rules)
+	}
+	Override.Rules[name] = rules
+	current.Store(config)
+	for _, line := range Diff(previous, config) {
+		log.Info("Config changed: %s", line)
+	}
+	return nil
+}
+
+// ResetRules drops the rules set at runtime for the named policy and reloads
+// the config file
+func ResetRules(name string) error {
+	updating.Lock()
+	delete(Override.Rules, name)
+	updating.Unlock()
+	return Reload()
+}
+
+// RulesEdited tells whether the rules of the named policy were set at runtime
+func RulesEdited(name string) bool {
+	updating.Lock()
+	defer updating.Unlock()
+	_, ok := Override.Rules[name]
+	return ok
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Timeouts in seconds, unset ones fall back to the defaults below
+type Timeouts struct {
+	// Connecting to the upstream server
+	Dial int `json:"dial"`
+	// Reading the request line and headers once the request has started,
+	// and the TLS handshake or SOCKS negotiation
+	Header int `json:"header"`
+	// Inactivity while reading a request body from the client or a
+	// response from the upstream, and while writing to the client
+	Body int `json:"body"`
+	// Waiting for a request to start on a new connection
+	Idle int `json:"idle"`
+	// CONNECT and SOCKS tunnels without traffic in either direction
+	Tunnel int `json:"tunnel"`
+}
+
+const (
+	DefaultDialTimeout   = 10 * time.Second
+	DefaultHeaderTimeout = 10 * time.Second
+	DefaultBodyTimeout   = 60 * time.Second
+	DefaultIdleTimeout   = 30 * time.Second
+	DefaultTunnelTimeout = 5 * time.Minute
+)
+
+func seconds(n int, fallback time.Duration) time.Duration {
+	if n <= 0 {
+		return fallback
+	}
+	return time.Duration(n) * time.Second
+}
+
+func (timeouts *Timeouts) DialTimeout() time.Duration {
+	return seconds(timeouts.Dial, DefaultDialTimeout)
+}
+
+func (timeouts *Timeouts) HeaderTimeout() time.Duration {
+	return seconds(timeouts.Header, DefaultHeaderTimeout)
+}
+
+func (timeouts *Timeouts) BodyTimeout() time.Duration {
+	return seconds(timeouts.Body, DefaultBodyTimeout)
+}
+
+func (timeouts *Timeouts) IdleTimeout() time.Duration {
+	return seconds(timeouts.Idle, DefaultIdleTimeout)
+}
+
+func (timeouts *Timeouts) TunnelTimeout() time.Duration {
+	return seconds(timeouts.Tunnel, DefaultTunnelTimeout)
+}
+
+func (timeouts *Timeouts) Validate() error {
+	names := []string{"dial", "header", "body", "idle", "tunnel"}
+	for i, n := range []int{timeouts.Dial, timeouts.Header, timeouts.Body, timeouts.Idle, timeouts.Tunnel} {
+		if n < 0 {
+			return fmt.Errorf("Invalid %s timeout: %d", names[i], n)
+		}
+	}
+	return nil
+}
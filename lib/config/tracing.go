@@ -0,0 +1,54 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	DefaultServiceName   = "prgoxy"
+	DefaultExportTimeout = 10 * time.Second
+)
+
+// Tracing exports a span per request to an OTLP/HTTP collector. Request ids
+// and traceparent propagation don't depend on it.
+type Tracing struct {
+	// Traces url of the collector, e.g. http://127.0.0.1:4318/v1/traces,
+	// spans are not exported if unset
+	Endpoint string `json:"endpoint"`
+	// service.name of the spans, prgoxy if unset
+	ServiceName string `json:"service_name"`
+	// Seconds an export may take, 10 if unset
+	Timeout int `json:"timeout"`
+}
+
+func (tracing *Tracing) Validate() error {
+	if tracing.Endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(tracing.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid tracing endpoint: %q", tracing.Endpoint)
+	}
+	if tracing.Timeout < 0 {
+		return fmt.Errorf("Invalid tracing timeout: %d", tracing.Timeout)
+	}
+	return nil
+}
+
+// Exporting tells whether spans are sent to a collector
+func (tracing *Tracing) Exporting() bool {
+	return tracing.Endpoint != ""
+}
+
+func (tracing *Tracing) Service() string {
+	if tracing.ServiceName == "" {
+		return DefaultServiceName
+	}
+	return tracing.ServiceName
+}
+
+func (tracing *Tracing) ExportTimeout() time.Duration {
+	return seconds(tracing.Timeout, DefaultExportTimeout)
+}
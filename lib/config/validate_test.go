@@ -0,0 +1,85 @@
+package config
+
+import "testing"
+
+type validator interface {
+	Validate() error
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		value validator
+		valid bool
+	}{
+		{"no limits", &Limits{}, true},
+		{"limits", &Limits{MaxConnections: 1024, PerClient: 64, Queue: QueueWait, QueueTimeout: 10}, true},
+		{"negative limit", &Limits{PerHost: -1}, false},
+		{"unknown queue", &Limits{Queue: "drop"}, false},
+
+		{"default timeouts", &Timeouts{}, true},
+		{"timeouts", &Timeouts{Dial: 5, Body: 120}, true},
+		{"negative timeout", &Timeouts{Idle: -1}, false},
+
+		{"no access log", &AccessLog{}, true},
+		{"json access log", &AccessLog{Path: "-", Format: AccessLogJSON}, true},
+		{"unknown access log format", &AccessLog{Format: "xml"}, false},
+
+		{"empty policy", &Policy{}, true},
+		{"policy", &Policy{
+			Block:    Block{Sites: []string{"a.test"}},
+			Redirect: map[string]string{"a.test:80": "b.test:8080"},
+			Auth:     map[string]string{"alice": "secret"},
+		}, true},
+		{"blocked site with port", &Policy{Block: Block{Sites: []string{"a.test:80"}}}, false},
+		{"redirect to a bad port", &Policy{Redirect: map[string]string{"a.test": "b.test:99999"}}, false},
+		{"user with colon", &Policy{Auth: map[string]string{"a:b": "secret"}}, false},
+
+		{"no replay", &Replay{}, true},
+		{"record", &Replay{Mode: ReplayRecord, Archive: "a.jsonl"}, true},
+		{"replay passing", &Replay{Mode: ReplayReplay, Archive: "a.jsonl", Unmatched: ReplayUnmatchedPass}, true},
+		{"replay without archive", &Replay{Mode: ReplayReplay}, false},
+		{"unknown replay mode", &Replay{Mode: "rewind", Archive: "a.jsonl"}, false},
+		{"unknown unmatched", &Replay{Mode: ReplayReplay, Archive: "a.jsonl", Unmatched: "ignore"}, false},
+
+		{"no tracing", &Tracing{}, true},
+		{"tracing", &Tracing{Endpoint: "http://127.0.0.1:4318/v1/traces", Timeout: 5}, true},
+		{"tracing without scheme", &Tracing{Endpoint: "127.0.0.1:4318"}, false},
+		{"tracing over grpc", &Tracing{Endpoint: "grpc://127.0.0.1:4317"}, false},
+		{"negative tracing timeout", &Tracing{Endpoint: "http://127.0.0.1:4318/v1/traces", Timeout: -1}, false},
+	}
+	for _, test := range tests {
+		err := test.value.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("%s: Validate() = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestListenerValidate(t *testing.T) {
+	config := &Config{Policies: map[string]Policy{"guest": {}}}
+	tests := []struct {
+		name     string
+		listener Listener
+		valid    bool
+	}{
+		{"http", Listener{Name: "a", LHost: "127.0.0.1", LPort: 8080}, true},
+		{"socks with policy", Listener{Name: "a", LPort: 1080, Protocol: ProtocolSOCKS, Policy: "guest"}, true},
+		{"reverse", Listener{Name: "a", LPort: 80, Protocol: ProtocolReverse, Upstream: "127.0.0.1:8000"}, true},
+		{"tls", Listener{Name: "a", LPort: 8443, TLS: &TLS{Cert: "a.pem", Key: "a.key", ClientAuth: "optional"}}, true},
+		{"no name", Listener{LPort: 8080}, false},
+		{"hostname bind address", Listener{Name: "a", LHost: "localhost", LPort: 8080}, false},
+		{"port out of range", Listener{Name: "a", LPort: 70000}, false},
+		{"reverse without upstream", Listener{Name: "a", LPort: 80, Protocol: ProtocolReverse}, false},
+		{"unknown protocol", Listener{Name: "a", LPort: 80, Protocol: "ftp"}, false},
+		{"tls without key", Listener{Name: "a", LPort: 8443, TLS: &TLS{Cert: "a.pem"}}, false},
+		{"unknown client auth", Listener{Name: "a", LPort: 8443, TLS: &TLS{Cert: "a.pem", Key: "a.key", ClientAuth: "maybe"}}, false},
+		{"unknown policy", Listener{Name: "a", LPort: 8080, Policy: "admin"}, false},
+	}
+	for _, test := range tests {
+		err := test.listener.Validate(config)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: Validate() = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/WangYihang/PrGoxy/lib/util/log"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watch reloads the config whenever the config file or one of the files it
+// includes changes on disk, or SIGHUP is received, it never returns
+func Watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var events chan fsnotify.Event
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Warn("Can not watch config file, reload with SIGHUP only: %s", err)
+	} else {
+		defer watcher.Close()
+		events = watcher.Events
+		go func() {
+			for err := range watcher.Errors {
+				log.Error("Config watcher: %s", err)
+			}
+		}()
+		watchFiles(watcher)
+	}
+
+	// A single save usually fires several events, wait for them to settle
+	var settle <-chan time.Time
+	for {
+		select {
+		case <-hup:
+			log.Info("SIGHUP received, reloading config")
+			reload()
+		case event := <-events:
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 || !isConfigFile(event.Name) {
+				continue
+			}
+			settle = time.After(100 * time.Millisecond)
+		case <-settle:
+			log.Info("Config file changed, reloading config")
+			reload()
+		}
+		if watcher != nil {
+			// Includes may have been added
+			watchFiles(watcher)
+		}
+	}
+}
+
+// watchFiles watches the directories of the config files, editors often
+// replace a file instead of writing to it, which would drop a watch on the
+// file itself
+func watchFiles(watcher *fsnotify.Watcher) {
+	for _, file := range Get().Files {
+		err := watcher.Add(filepath.Dir(file))
+		if err != nil {
+			log.Warn("Can not watch %s, reload with SIGHUP: %s", file, err)
+		}
+	}
+}
+
+func isConfigFile(name string) bool {
+	name, err := filepath.Abs(name)
+	if err != nil {
+		return false
+	}
+	for _, file := range Get().Files {
+		if name == file {
+			return true
+		}
+	}
+	return false
+}
+
+func reload() {
+	err := Reload()
+	if err != nil {
+		log.Warn("Config rejected, keeping the previous one: %s", err)
+	}
+}
@@ -0,0 +1,132 @@
+// Package har holds the types of the HTTP Archive format 1.2, see
+// http://www.softwareishard.com/blog/har-12-spec/
+package har
+
+import (
+	"sort"
+	"time"
+)
+
+type HAR struct {
+	Log Log `json:"log"`
+}
+
+type Log struct {
+	Version string  `json:"version"`
+	Creator Creator `json:"creator"`
+	Entries []Entry `json:"entries"`
+	Comment string  `json:"comment,omitempty"`
+}
+
+type Creator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Create returns an archive of the entries made by PrGoxy
+func Create(entries []Entry, comment string) *HAR {
+	if entries == nil {
+		entries = []Entry{}
+	}
+	return &HAR{
+		Log: Log{
+			Version: "1.2",
+			Creator: Creator{
+				Name:    "PrGoxy",
+				Version: "dev",
+			},
+			Entries: entries,
+			Comment: comment,
+		},
+	}
+}
+
+type Entry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	// Milliseconds, the sum of the timings that apply
+	Time            float64  `json:"time"`
+	Request         Request  `json:"request"`
+	Response        Response `json:"response"`
+	Cache           Cache    `json:"cache"`
+	Timings         Timings  `json:"timings"`
+	ServerIPAddress string   `json:"serverIPAddress,omitempty"`
+	Connection      string   `json:"connection,omitempty"`
+	Comment         string   `json:"comment,omitempty"`
+}
+
+type NameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Headers turns a header map into name/value pairs sorted by name
+func Headers(headers map[string]string) []NameValue {
+	pairs := make([]NameValue, 0, len(headers))
+	for k, v := range headers {
+		pairs = append(pairs, NameValue{Name: k, Value: v})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Name < pairs[j].Name
+	})
+	return pairs
+}
+
+// Sizes are -1 when unknown
+type Request struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []NameValue `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	QueryString []NameValue `json:"queryString"`
+	PostData    *PostData   `json:"postData,omitempty"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+// PostData has no encoding, binary bodies can't be stored
+type PostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type Response struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []NameValue `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	Content     Content     `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+type Content struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	// base64 for binary content
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// Cache is left empty, what cache did is in the entry comment
+type Cache struct{}
+
+// Timings are in milliseconds, -1 for steps that don't apply
+type Timings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// Milliseconds converts a duration to the unit of timings
+func Milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,312 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric is written out in the Prometheus text format
+type Metric interface {
+	Write(w io.Writer)
+}
+
+var (
+	registryLock = new(sync.Mutex)
+	registry     []Metric
+)
+
+func register(metric Metric) {
+	registryLock.Lock()
+	registry = append(registry, metric)
+	registryLock.Unlock()
+}
+
+// Write writes every metric in the order they were created
+func Write(w io.Writer) {
+	registryLock.Lock()
+	metrics := append([]Metric{}, registry...)
+	registryLock.Unlock()
+	for _, metric := range metrics {
+		metric.Write(w)
+	}
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+// labelString formats label pairs as {a="x",b="y"}, extra pairs are added
+// after the named ones
+func labelString(names []string, values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, labelEscaper.Replace(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extra[i], labelEscaper.Replace(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// series holds one value per combination of label values
+type series struct {
+	Name   string
+	Help   string
+	Labels []string
+	Lock   *sync.Mutex
+	Values map[string]float64
+}
+
+func createSeries(name string, help string, labels []string) *series {
+	return &series{
+		Name:   name,
+		Help:   help,
+		Labels: labels,
+		Lock:   new(sync.Mutex),
+		Values: make(map[string]float64),
+	}
+}
+
+// Label values are joined with a byte that can't appear in them
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func (o *series) add(v float64, values []string) {
+	if len(values) != len(o.Labels) {
+		panic(fmt.Sprintf("metric %s takes %d labels, %d given", o.Name, len(o.Labels), len(values)))
+	}
+	o.Lock.Lock()
+	o.Values[seriesKey(values)] += v
+	o.Lock.Unlock()
+}
+
+func (o *series) set(v float64, values []string) {
+	o.Lock.Lock()
+	o.Values[seriesKey(values)] = v
+	o.Lock.Unlock()
+}
+
+// Sum adds up the values whose labels match the given name, value pairs,
+// e.g. Sum("direction", "in") for every peer
+func (o *series) Sum(pairs ...string) float64 {
+	index := make(map[int]string)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		found := false
+		for j, name := range o.Labels {
+			if name == pairs[i] {
+				index[j] = pairs[i+1]
+				found = true
+			}
+		}
+		if !found {
+			return 0
+		}
+	}
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	sum := 0.0
+	for k, v := range o.Values {
+		values := strings.Split(k, "\xff")
+		match := true
+		for j, value := range index {
+			if values[j] != value {
+				match = false
+				break
+			}
+		}
+		if match {
+			sum += v
+		}
+	}
+	return sum
+}
+
+func (o *series) write(w io.Writer, kind string) {
+	o.Lock.Lock()
+	keys := make([]string, 0, len(o.Values))
+	for k := range o.Values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	values := make([]float64, len(keys))
+	for i, k := range keys {
+		values[i] = o.Values[k]
+	}
+	o.Lock.Unlock()
+	writeHeader(w, o.Name, o.Help, kind)
+	if len(o.Labels) == 0 && len(keys) == 0 {
+		// Unlabeled metrics start at zero
+		fmt.Fprintf(w, "%s 0\n", o.Name)
+		return
+	}
+	for i, k := range keys {
+		var labelValues []string
+		if len(o.Labels) > 0 {
+			labelValues = strings.Split(k, "\xff")
+		}
+		fmt.Fprintf(w, "%s%s %s\n", o.Name, labelString(o.Labels, labelValues), formatValue(values[i]))
+	}
+}
+
+type Counter struct {
+	*series
+}
+
+func CreateCounter(name string, help string, labels ...string) *Counter {
+	counter := &Counter{createSeries(name, help, labels)}
+	register(counter)
+	return counter
+}
+
+func (o *Counter) Add(v float64, labelValues ...string) {
+	o.add(v, labelValues)
+}
+
+func (o *Counter) Inc(labelValues ...string) {
+	o.add(1, labelValues)
+}
+
+func (o *Counter) Write(w io.Writer) {
+	o.write(w, "counter")
+}
+
+type Gauge struct {
+	*series
+}
+
+func CreateGauge(name string, help string, labels ...string) *Gauge {
+	gauge := &Gauge{createSeries(name, help, labels)}
+	register(gauge)
+	return gauge
+}
+
+func (o *Gauge) Set(v float64, labelValues ...string) {
+	o.set(v, labelValues)
+}
+
+func (o *Gauge) Add(v float64, labelValues ...string) {
+	o.add(v, labelValues)
+}
+
+func (o *Gauge) Write(w io.Writer) {
+	o.write(w, "gauge")
+}
+
+// GaugeFunc is a gauge whose value is computed when scraped
+type GaugeFunc struct {
+	Name     string
+	Help     string
+	Function func() float64
+}
+
+func CreateGaugeFunc(name string, help string, function func() float64) *GaugeFunc {
+	gauge := &GaugeFunc{
+		Name:     name,
+		Help:     help,
+		Function: function,
+	}
+	register(gauge)
+	return gauge
+}
+
+func (o *GaugeFunc) Write(w io.Writer) {
+	writeHeader(w, o.Name, o.Help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", o.Name, formatValue(o.Function()))
+}
+
+// DefaultBuckets suit latencies in seconds
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type Histogram struct {
+	Name    string
+	Help    string
+	Labels  []string
+	Buckets []float64
+	Lock    *sync.Mutex
+	// Per combination of label values: count per bucket, then sum and count
+	Counts map[string][]uint64
+	Sums   map[string]float64
+}
+
+func CreateHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	histogram := &Histogram{
+		Name:    name,
+		Help:    help,
+		Labels:  labels,
+		Buckets: buckets,
+		Lock:    new(sync.Mutex),
+		Counts:  make(map[string][]uint64),
+		Sums:    make(map[string]float64),
+	}
+	register(histogram)
+	return histogram
+}
+
+func (o *Histogram) Observe(v float64, labelValues ...string) {
+	if len(labelValues) != len(o.Labels) {
+		panic(fmt.Sprintf("metric %s takes %d labels, %d given", o.Name, len(o.Labels), len(labelValues)))
+	}
+	key := seriesKey(labelValues)
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	counts, ok := o.Counts[key]
+	if !ok {
+		// One more for +Inf
+		counts = make([]uint64, len(o.Buckets)+1)
+		o.Counts[key] = counts
+	}
+	for i, bound := range o.Buckets {
+		if v <= bound {
+			counts[i]++
+		}
+	}
+	counts[len(o.Buckets)]++
+	o.Sums[key] += v
+}
+
+func (o *Histogram) Write(w io.Writer) {
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	writeHeader(w, o.Name, o.Help, "histogram")
+	keys := make([]string, 0, len(o.Counts))
+	for k := range o.Counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var labelValues []string
+		if len(o.Labels) > 0 {
+			labelValues = strings.Split(k, "\xff")
+		}
+		counts := o.Counts[k]
+		for i, bound := range o.Buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", o.Name, labelString(o.Labels, labelValues, "le", formatValue(bound)), counts[i])
+		}
+		total := counts[len(o.Buckets)]
+		fmt.Fprintf(w, "%s_bucket%s %d\n", o.Name, labelString(o.Labels, labelValues, "le", "+Inf"), total)
+		fmt.Fprintf(w, "%s_sum%s %s\n", o.Name, labelString(o.Labels, labelValues), formatValue(o.Sums[k]))
+		fmt.Fprintf(w, "%s_count%s %d\n", o.Name, labelString(o.Labels, labelValues), total)
+	}
+}
@@ -0,0 +1,211 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/WangYihang/PrGoxy/lib/config"
+	"github.com/WangYihang/PrGoxy/lib/util/log"
+)
+
+// How a request was answered by cache
+const (
+	CacheStatusHit         = "HIT"
+	CacheStatusMiss        = "MISS"
+	CacheStatusRevalidated = "REVALIDATED"
+	CacheStatusStale       = "STALE"
+)
+
+// What filters, auth, limits and redirects decided, empty if they let the
+// request through untouched
+const (
+	DecisionBlockedClient = "blocked client"
+	DecisionBlockedSite   = "blocked site"
+	DecisionUnauthorized  = "unauthorized"
+	DecisionRejected      = "rejected"
+	DecisionRedirected    = "redirected to"
+	DecisionReplayed      = "replayed"
+	DecisionNotInArchive  = "not in replay archive"
+	DecisionKilled        = "killed"
+)
+
+type AccessRecord struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	User      string    `json:"user,omitempty"`
+	Listener  string    `json:"listener"`
+	Method    string    `json:"method"`
+	URL       string    `json:"url"`
+	Protocol  string    `json:"protocol"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"duration"`
+	Cache     string    `json:"cache,omitempty"`
+	Decision  string    `json:"decision,omitempty"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	TraceID   string    `json:"trace_id,omitempty"`
+	// Seconds spent in each phase that happened, by name
+	Timings map[string]float64 `json:"timings,omitempty"`
+}
+
+func CreateAccessRecord(o *TCPClient) *AccessRecord {
+	client := o.Conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	record := &AccessRecord{
+		Time:      o.Started,
+		Client:    client,
+		User:      o.User,
+		Listener:  o.Server.Listener.Name,
+		Method:    o.Request.Method,
+		Protocol:  o.Request.HTTPVersion,
+		Status:    o.Status,
+		Bytes:     atomic.LoadInt64(&o.Sent),
+		Duration:  time.Since(o.Started).Seconds(),
+		Cache:     o.CacheStatus,
+		Decision:  o.Decision,
+		Referer:   o.Request.Headers["Referer"],
+		UserAgent: o.Request.Headers["User-Agent"],
+		RequestID: o.RequestID,
+		TraceID:   o.Trace.TraceID,
+	}
+	for _, phase := range o.Timings.Phases() {
+		if record.Timings == nil {
+			record.Timings = make(map[string]float64)
+		}
+		record.Timings[phase.Name] = phase.Duration.Seconds()
+	}
+	if record.Decision == "" && atomic.LoadInt32(&o.Killed) == 1 {
+		record.Decision = DecisionKilled
+	}
+	if o.Protocol != "" {
+		// Requests are forwarded as HTTP/1.0 whatever the client spoke
+		record.Protocol = o.Protocol
+	}
+	if o.Request.RequestURI != nil {
+		record.URL = o.Request.RequestURI.String()
+		if o.Request.Method == "CONNECT" {
+			record.URL = o.Request.RequestURI.Host
+		}
+	}
+	return record
+}
+
+// quote escapes a field of the Apache formats, empty fields are -
+func quote(field string) string {
+	if field == "" {
+		return "-"
+	}
+	quoted := strconv.Quote(field)
+	return quoted[1 : len(quoted)-1]
+}
+
+func dashIfZero(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// Common formats the record in Apache Common Log Format
+func (r *AccessRecord) Common() string {
+	request := strings.TrimSpace(strings.Join([]string{r.Method, r.URL, r.Protocol}, " "))
+	return fmt.Sprintf(
+		"%s - %s [%s] \"%s\" %s %s",
+		r.Client,
+		quote(r.User),
+		r.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		quote(request),
+		dashIfZero(int64(r.Status)),
+		dashIfZero(r.Bytes),
+	)
+}
+
+// Combined formats the record in Apache Combined Log Format, cache status,
+// decision, duration, ids and timings are only in the json format
+func (r *AccessRecord) Combined() string {
+	return fmt.Sprintf("%s \"%s\" \"%s\"", r.Common(), quote(r.Referer), quote(r.UserAgent))
+}
+
+func (r *AccessRecord) Format(format string) string {
+	switch format {
+	case config.AccessLogCommon:
+		return r.Common()
+	case config.AccessLogJSON:
+		data, err := json.Marshal(r)
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+	return r.Combined()
+}
+
+// AccessLogger writes the access log, the file is reopened whenever config is
+// reloaded so it can be rotated with SIGHUP
+type AccessLogger struct {
+	Lock *sync.Mutex
+	// Config snapshot the file was opened for
+	Config *config.Config
+	File   *os.File
+}
+
+var AccessLog = &AccessLogger{
+	Lock: new(sync.Mutex),
+}
+
+// Requested tells clients that sent a request, or that a filter turned away
+// before they could, from connections that never got anywhere
+func (o *TCPClient) Requested() bool {
+	return o.Request.Method != "" || o.Decision != ""
+}
+
+// Log writes the record of a client once it is done
+func (o *AccessLogger) Log(record *AccessRecord) {
+	cfg := config.Get()
+	if cfg.AccessLog.Path == "" {
+		return
+	}
+	line := record.Format(cfg.AccessLog.Format) + "\n"
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	if o.Config != cfg {
+		o.open(cfg)
+	}
+	if o.File == nil {
+		return
+	}
+	_, err := o.File.WriteString(line)
+	if err != nil {
+		log.Error("Failed to write access log: %s", err)
+	}
+}
+
+// open switches to the file of cfg, the lock must be held
+func (o *AccessLogger) open(cfg *config.Config) {
+	if o.File != nil && o.File != os.Stdout {
+		o.File.Close()
+	}
+	o.File = nil
+	o.Config = cfg
+	if cfg.AccessLog.Path == "-" {
+		o.File = os.Stdout
+		return
+	}
+	file, err := os.OpenFile(cfg.AccessLog.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Error("Failed to open access log: %s", err)
+		return
+	}
+	o.File = file
+}
@@ -0,0 +1,208 @@
+package model
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/WangYihang/PrGoxy/lib/config"
+	"github.com/WangYihang/PrGoxy/lib/util/log"
+)
+
+var ErrLimitReached = errors.New("connection limit reached")
+
+// Admission counts connections against the configured limits, shared by all
+// listeners. Counts are keyed by limit: the total, one per client IP and one
+// per upstream host.
+type Admission struct {
+	Lock    *sync.Mutex
+	Changed *sync.Cond
+	Counts  map[string]int
+	// Connections waiting for a slot
+	Queued int
+	// Rejected connections by limit
+	Rejected map[string]int
+}
+
+const (
+	limitConnections = "connections"
+	limitClient      = "client"
+	limitHost        = "host"
+)
+
+var Admissions = CreateAdmission()
+
+func CreateAdmission() *Admission {
+	lock := new(sync.Mutex)
+	return &Admission{
+		Lock:     lock,
+		Changed:  sync.NewCond(lock),
+		Counts:   make(map[string]int),
+		Rejected: make(map[string]int),
+	}
+}
+
+// Limit is one counter to take a slot of, a zero Max is unlimited
+type Limit struct {
+	Kind string
+	Key  string
+	Max  int
+}
+
+func (l Limit) counter() string {
+	if l.Key == "" {
+		return l.Kind
+	}
+	return l.Kind + " " + l.Key
+}
+
+// full returns the first limit without a free slot, the lock must be held
+func (o *Admission) full(limits []Limit) (Limit, bool) {
+	for _, l := range limits {
+		if l.Max > 0 && o.Counts[l.counter()] >= l.Max {
+			return l, true
+		}
+	}
+	return Limit{}, false
+}
+
+// Acquire takes a slot of every limit, waiting up to wait for them to free
+// up. The returned function gives the slots back. Waiting stops early once
+// cancel returns true.
+func (o *Admission) Acquire(limits []Limit, wait time.Duration, cancel func() bool) (func(), error) {
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	l, full := o.full(limits)
+	if full && wait > 0 {
+		deadline := time.Now().Add(wait)
+		timer := time.AfterFunc(wait, o.Wake)
+		defer timer.Stop()
+		o.Queued++
+		for full && time.Now().Before(deadline) && !cancel() {
+			o.Changed.Wait()
+			l, full = o.full(limits)
+		}
+		o.Queued--
+	}
+	if full {
+		o.Rejected[l.Kind]++
+		return nil, ErrLimitReached
+	}
+	for _, l := range limits {
+		o.Counts[l.counter()]++
+	}
+	return func() {
+		o.Lock.Lock()
+		for _, l := range limits {
+			counter := l.counter()
+			o.Counts[counter]--
+			if o.Counts[counter] <= 0 {
+				delete(o.Counts, counter)
+			}
+		}
+		o.Lock.Unlock()
+		o.Changed.Broadcast()
+	}, nil
+}
+
+// WaitBelow blocks while the total of client connections is at max, or until
+// cancel returns true
+func (o *Admission) WaitBelow(max int, cancel func() bool) {
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	for max > 0 && o.Counts[limitConnections] >= max && !cancel() {
+		o.Changed.Wait()
+	}
+}
+
+// Wake makes waiting connections check their limits again
+func (o *Admission) Wake() {
+	o.Lock.Lock()
+	o.Lock.Unlock()
+	o.Changed.Broadcast()
+}
+
+type AdmissionStats struct {
+	Connections    int            `json:"connections"`
+	MaxConnections int            `json:"max_connections"`
+	Clients        map[string]int `json:"clients"`
+	PerClient      int            `json:"per_client"`
+	Hosts          map[string]int `json:"hosts"`
+	PerHost        int            `json:"per_host"`
+	Queue          string         `json:"queue"`
+	Queued         int            `json:"queued"`
+	Rejected       map[string]int `json:"rejected"`
+}
+
+func (o *Admission) Stats(limits *config.Limits) AdmissionStats {
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	stats := AdmissionStats{
+		Connections:    o.Counts[limitConnections],
+		MaxConnections: limits.MaxConnections,
+		Clients:        make(map[string]int),
+		PerClient:      limits.PerClient,
+		Hosts:          make(map[string]int),
+		PerHost:        limits.PerHost,
+		Queue:          config.QueueReject,
+		Queued:         o.Queued,
+		Rejected:       make(map[string]int),
+	}
+	if limits.Wait() {
+		stats.Queue = config.QueueWait
+	}
+	for k, v := range o.Counts {
+		if strings.HasPrefix(k, limitClient+" ") {
+			stats.Clients[k[len(limitClient)+1:]] = v
+		} else if strings.HasPrefix(k, limitHost+" ") {
+			stats.Hosts[k[len(limitHost)+1:]] = v
+		}
+	}
+	for k, v := range o.Rejected {
+		stats.Rejected[k] = v
+	}
+	return stats
+}
+
+// Admit takes the client's slots of the total and per client IP limits, they
+// are given back when the client is deleted
+func (o *TCPClient) Admit() error {
+	limits := &o.Config.Limits
+	ip, _, err := net.SplitHostPort(o.Conn.RemoteAddr().String())
+	if err != nil {
+		ip = o.Conn.RemoteAddr().String()
+	}
+	release, err := Admissions.Acquire([]Limit{
+		{Kind: limitConnections, Max: limits.MaxConnections},
+		{Kind: limitClient, Key: ip, Max: limits.PerClient},
+	}, limits.QueueTimeoutDuration(), o.Server.IsClosing)
+	if err != nil {
+		log.Warn("Client (%s) rejected: %s", o.ToString(), err)
+		return err
+	}
+	o.Release = release
+	return nil
+}
+
+// AdmitHost takes a slot of the per host limit for an upstream connection
+func AdmitHost(o *TCPClient, host string) (func(), error) {
+	limits := &o.Config.Limits
+	return Admissions.Acquire([]Limit{
+		{Kind: limitHost, Key: strings.ToLower(host), Max: limits.PerHost},
+	}, limits.QueueTimeoutDuration(), o.Server.IsClosing)
+}
+
+// Reject answers a client over its limits, SOCKS clients are just closed
+func (o *TCPClient) Reject() {
+	if o.Server.Listener.Protocol == config.ProtocolSOCKS {
+		o.Decision = DecisionRejected
+		o.Server.DeleteTCPClient(o)
+		return
+	}
+	response := CreateErrorResponse(503, "Service Unavailable")
+	response.Headers["Retry-After"] = "1"
+	o.Decision = DecisionRejected
+	o.Respond(response)
+}
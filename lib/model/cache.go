@@ -0,0 +1,346 @@
+package model
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/WangYihang/PrGoxy/lib/config"
+	"github.com/WangYihang/PrGoxy/lib/util/log"
+)
+
+const (
+	WarningStale            = "110 - \"Response is Stale\""
+	WarningRevalidateFailed = "111 - \"Revalidation Failed\""
+)
+
+// ParseCacheControl splits a Cache-Control header into its directives,
+// directives without an argument map to an empty string
+func ParseCacheControl(header string) map[string]string {
+	directives := make(map[string]string)
+	for _, directive := range strings.Split(header, ",") {
+		directive = strings.TrimSpace(directive)
+		if directive == "" {
+			continue
+		}
+		if index := strings.Index(directive, "="); index >= 0 {
+			key := strings.ToLower(strings.TrimSpace(directive[:index]))
+			directives[key] = strings.Trim(strings.TrimSpace(directive[index+1:]), "\"")
+		} else {
+			directives[strings.ToLower(directive)] = ""
+		}
+	}
+	return directives
+}
+
+func directiveSeconds(directives map[string]string, key string) (time.Duration, bool) {
+	v, ok := directives[key]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// cachableStatus lists the status codes cache keeps, those RFC 7231 makes
+// cacheable by default. 206 is left out, partial responses are built from
+// whole objects.
+var cachableStatus = map[int]bool{
+	200: true,
+	203: true,
+	204: true,
+	300: true,
+	301: true,
+	404: true,
+	405: true,
+	410: true,
+	414: true,
+}
+
+// Shareable tells whether the response may be served to other clients: it
+// isn't private, no-store or setting cookies
+func (response *HTTPResponse) Shareable() bool {
+	cacheControl, _ := HeaderValue(response.Headers, "Cache-Control")
+	directives := ParseCacheControl(cacheControl)
+	for _, key := range []string{"private", "no-store"} {
+		if _, ok := directives[key]; ok {
+			return false
+		}
+	}
+	_, setCookie := HeaderValue(response.Headers, "Set-Cookie")
+	return !setCookie
+}
+
+// Storable tells whether the shared cache may keep the response
+func (response *HTTPResponse) Storable() bool {
+	return cachableStatus[response.StatusCode] && response.Shareable()
+}
+
+// FreshnessLifetime is how long a response may be served without asking the
+// origin, responses without explicit freshness are always revalidated
+func (response *HTTPResponse) FreshnessLifetime() time.Duration {
+	if !response.Shareable() {
+		return 0
+	}
+	directives := ParseCacheControl(response.Headers["Cache-Control"])
+	if _, ok := directives["no-cache"]; ok {
+		return 0
+	}
+	if lifetime, ok := directiveSeconds(directives, "s-maxage"); ok {
+		return lifetime
+	}
+	if lifetime, ok := directiveSeconds(directives, "max-age"); ok {
+		return lifetime
+	}
+	if v, ok := response.Headers["Expires"]; ok {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0
+		}
+		date := response.Received
+		if v, ok := response.Headers["Date"]; ok {
+			if t, err := http.ParseTime(v); err == nil {
+				date = t
+			}
+		}
+		if lifetime := expires.Sub(date); lifetime > 0 {
+			return lifetime
+		}
+	}
+	return 0
+}
+
+// Staleness is how long ago the response stopped being fresh, it is not
+// positive while the response is still fresh
+func (response *HTTPResponse) Staleness() time.Duration {
+	return time.Since(response.Received) - response.FreshnessLifetime()
+}
+
+// StaleWindows returns how long past its freshness a response may be served
+// while it is revalidated in the background, and while the origin is failing.
+// Directives from the response win over the configured defaults.
+func (response *HTTPResponse) StaleWindows(cfg *config.Config) (whileRevalidate time.Duration, ifError time.Duration) {
+	if !response.Shareable() {
+		return 0, 0
+	}
+	directives := ParseCacheControl(response.Headers["Cache-Control"])
+	for _, key := range []string{"must-revalidate", "proxy-revalidate", "no-cache"} {
+		if _, ok := directives[key]; ok {
+			return 0, 0
+		}
+	}
+	whileRevalidate = time.Duration(cfg.Stale.WhileRevalidate) * time.Second
+	if v, ok := directiveSeconds(directives, "stale-while-revalidate"); ok {
+		whileRevalidate = v
+	}
+	ifError = time.Duration(cfg.Stale.IfError) * time.Second
+	if v, ok := directiveSeconds(directives, "stale-if-error"); ok {
+		ifError = v
+	}
+	return whileRevalidate, ifError
+}
+
+// WithWarning returns a copy of the response carrying a Warning header, the
+// cached response itself is shared and must not be modified
+func (response *HTTPResponse) WithWarning(warning string) *HTTPResponse {
+	warned := *response
+	warned.Headers = make(map[string]string)
+	for k, v := range response.Headers {
+		warned.Headers[k] = v
+	}
+	warned.Headers["Warning"] = warning
+	return &warned
+}
+
+func CopyHTTPRequest(request *HTTPRequest) *HTTPRequest {
+	copied := *request
+	uri := *request.RequestURI
+	copied.RequestURI = &uri
+	copied.Headers = make(map[string]string)
+	for k, v := range request.Headers {
+		copied.Headers[k] = v
+	}
+	return &copied
+}
+
+// Revalidate sends a conditional request for a cached response to the origin.
+// On 304 the cached response is returned with its age reset and notModified
+// set, otherwise the new response, nil means the origin could not be reached.
+func Revalidate(o *TCPClient, request *HTTPRequest, cached *HTTPResponse, timings *Timings) (response *HTTPResponse, notModified bool) {
+	var err error
+	// Send If-Modify-Since
+	ifModifySince := time.Time{}
+	if v, ok := cached.Headers["Last-Modified"]; ok {
+		ifModifySince, err = http.ParseTime(v)
+		if err != nil {
+			log.Debug("Failed to parse time, %s", err)
+		}
+	} else if v, ok := cached.Headers["Date"]; ok {
+		ifModifySince, err = http.ParseTime(v)
+		if err != nil {
+			log.Debug("Failed to parse time, %s", err)
+		}
+	} else {
+		ifModifySince = time.Now()
+	}
+	host := GetHostname(request.RequestURI.Host)
+	port := GetPort(request.RequestURI.Host, 80)
+	// The request may still be sent as is if the origin can't be reached
+	conditional := CopyHTTPRequest(request)
+	conditional.Headers["If-Modified-Since"] = ifModifySince.Format(time.RFC1123)
+	ifModifySinceResponse, err := o.Exchange(host, port, conditional, timings)
+	if err != nil {
+		log.Debug("Revalidation of %s failed: %s", request.RequestURI, err)
+		return nil, false
+	}
+	if ifModifySinceResponse.StatusCode == 0 {
+		// Connection dropped before a status line arrived
+		return nil, false
+	}
+	if ifModifySinceResponse.StatusCode == 304 {
+		refreshed := *cached
+		refreshed.Received = time.Now()
+		return &refreshed, true
+	}
+	return ifModifySinceResponse, false
+}
+
+// RevalidateInBackground refreshes a stale cache entry after the stale copy
+// has been sent, concurrent refreshes of the same uri are collapsed
+func RevalidateInBackground(o *TCPClient, request *HTTPRequest, cached HTTPResponse) {
+	uri := request.RequestURI.String()
+	Flights.Do(request.Method+" "+uri, func() *HTTPResponse {
+		// The client is gone already, its timings are left alone
+		response, notModified := Revalidate(o, request, &cached, nil)
+		if response == nil || response.StatusCode >= 500 {
+			log.Debug("Background revalidation of %s failed", uri)
+			return response
+		}
+		// A HEAD response has no body to keep
+		if notModified || request.Method == "GET" {
+			CacheStore(uri, response)
+		}
+		log.Debug("Background revalidation of %s done [%d]", uri, response.StatusCode)
+		return response
+	})
+}
+
+type CacheEntryInfo struct {
+	URL     string            `json:"url"`
+	Status  int               `json:"status"`
+	Size    int               `json:"size"`
+	Age     float64           `json:"age"`
+	Fresh   bool              `json:"fresh"`
+	TTL     float64           `json:"ttl"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+func CreateCacheEntryInfo(uri string, response *HTTPResponse) CacheEntryInfo {
+	staleness := response.Staleness()
+	return CacheEntryInfo{
+		URL:    uri,
+		Status: response.StatusCode,
+		Size:   len(response.Body),
+		Age:    time.Since(response.Received).Seconds(),
+		Fresh:  staleness <= 0,
+		TTL:    -staleness.Seconds(),
+	}
+}
+
+func CacheEntries() []CacheEntryInfo {
+	CacheLock.RLock()
+	defer CacheLock.RUnlock()
+	entries := make([]CacheEntryInfo, 0, len(Cache))
+	for k, v := range Cache {
+		entries = append(entries, CreateCacheEntryInfo(k, &v))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].URL < entries[j].URL
+	})
+	return entries
+}
+
+func CachePurge(uri string) bool {
+	CacheLock.Lock()
+	defer CacheLock.Unlock()
+	if _, ok := Cache[uri]; !ok {
+		return false
+	}
+	delete(Cache, uri)
+	CacheEvictions.Inc()
+	log.Info("Cache purged: %s", uri)
+	return true
+}
+
+// CachePurgeMatch removes every entry whose uri matches, the number of
+// removed entries is returned
+func CachePurgeMatch(match func(uri *url.URL) bool) int {
+	CacheLock.Lock()
+	defer CacheLock.Unlock()
+	n := 0
+	for k := range Cache {
+		uri, err := url.Parse(k)
+		if err != nil {
+			continue
+		}
+		if match(uri) {
+			delete(Cache, k)
+			n++
+		}
+	}
+	CacheEvictions.Add(float64(n))
+	log.Info("Cache purged: %d entries", n)
+	return n
+}
+
+func CachePurgeHost(host string) int {
+	return CachePurgeMatch(func(uri *url.URL) bool {
+		return strings.EqualFold(uri.Hostname(), host)
+	})
+}
+
+func CachePurgeRegexp(pattern *regexp.Regexp) int {
+	return CachePurgeMatch(func(uri *url.URL) bool {
+		return pattern.MatchString(uri.String())
+	})
+}
+
+func CacheFlush() int {
+	return CachePurgeMatch(func(uri *url.URL) bool {
+		return true
+	})
+}
+
+// PurgeHandler handles the PURGE method, which removes the Request-URI from
+// cache and is only accepted from the admin allow list
+func (o *TCPClient) PurgeHandler() {
+	if !o.Config.Admin.Allowed(o.Conn.RemoteAddr()) {
+		log.Warn("PURGE from %s is not allowed", o.ToString())
+		o.Respond(&HTTPResponse{
+			HTTPVersion:  "HTTP/1.0",
+			StatusCode:   403,
+			ReasonPhrase: "Forbidden",
+			Headers:      map[string]string{"Content-Length": "0"},
+		})
+		return
+	}
+	response := &HTTPResponse{
+		HTTPVersion:  "HTTP/1.0",
+		StatusCode:   200,
+		ReasonPhrase: "Purged",
+		Headers:      map[string]string{"Content-Length": "0"},
+	}
+	if !CachePurge(o.Request.RequestURI.String()) {
+		response.StatusCode = 404
+		response.ReasonPhrase = "Not Found"
+	}
+	o.Respond(response)
+	log.Info("PURGE %s %s [%d]", o.ToString(), o.Request.RequestURI, response.StatusCode)
+}
@@ -0,0 +1,49 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WangYihang/PrGoxy/lib/config"
+)
+
+func TestCacheStoreShared(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		headers map[string]string
+		stored  bool
+	}{
+		{"public", 200, map[string]string{"Cache-Control": "public, max-age=60"}, true},
+		{"not found", 404, map[string]string{"Cache-Control": "max-age=60"}, true},
+		{"private", 200, map[string]string{"Cache-Control": "private, max-age=60"}, false},
+		{"no-store", 200, map[string]string{"Cache-Control": "no-store"}, false},
+		{"lowercase header", 200, map[string]string{"cache-control": "Private"}, false},
+		{"cookie", 200, map[string]string{"Cache-Control": "max-age=60", "Set-Cookie": "session=1"}, false},
+		{"partial", 206, map[string]string{"Cache-Control": "max-age=60"}, false},
+		{"server error", 500, map[string]string{"Cache-Control": "max-age=60"}, false},
+	}
+	cfg := &config.Config{}
+	cfg.Stale.WhileRevalidate = 60
+	cfg.Stale.IfError = 3600
+	for _, test := range tests {
+		uri := "http://cache.test/" + test.name
+		// An entry held so far goes away once the origin forbids storing
+		CacheStore(uri, &HTTPResponse{StatusCode: 200, Headers: map[string]string{}})
+		response := &HTTPResponse{StatusCode: test.status, Headers: test.headers, Received: time.Now()}
+		CacheStore(uri, response)
+		if ok, _ := CacheHit(uri); ok != test.stored {
+			t.Errorf("%s: stored = %v, want %v", test.name, ok, test.stored)
+		}
+		CachePurge(uri)
+		if test.stored || test.status != 200 {
+			continue
+		}
+		if lifetime := response.FreshnessLifetime(); lifetime != 0 {
+			t.Errorf("%s: FreshnessLifetime = %s, want 0", test.name, lifetime)
+		}
+		if whileRevalidate, ifError := response.StaleWindows(cfg); whileRevalidate != 0 || ifError != 0 {
+			t.Errorf("%s: StaleWindows = %s, %s, want 0, 0", test.name, whileRevalidate, ifError)
+		}
+	}
+}
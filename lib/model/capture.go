@@ -0,0 +1,305 @@
+package model
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/WangYihang/PrGoxy/lib/har"
+)
+
+// Defaults of captures, what they keep stays in memory until deleted
+const (
+	DefaultCaptureEntries = 1000
+	DefaultCaptureBody    = 1 << 20
+)
+
+// Capture records the exchanges matching its filter as HAR entries, until
+// stopped or full
+type Capture struct {
+	ID     int
+	Filter *RequestFilter
+	// Filter as given, for listings
+	Query      string
+	MaxEntries int
+	// Bodies are cut to that many bytes
+	MaxBody int
+	Lock    *sync.Mutex
+	Started time.Time
+	Stopped time.Time
+	Entries []har.Entry
+}
+
+type CaptureInfo struct {
+	ID         int        `json:"id"`
+	Filter     string     `json:"filter"`
+	MaxEntries int        `json:"max_entries"`
+	MaxBody    int        `json:"max_body"`
+	Started    time.Time  `json:"started"`
+	Stopped    *time.Time `json:"stopped,omitempty"`
+	Entries    int        `json:"entries"`
+	Active     bool       `json:"active"`
+}
+
+type CaptureStore struct {
+	Lock     *sync.Mutex
+	Captures map[int]*Capture
+	Last     int
+}
+
+var Captures = &CaptureStore{
+	Lock:     new(sync.Mutex),
+	Captures: make(map[int]*Capture),
+}
+
+// Start begins a capture, zero limits take the defaults
+func (o *CaptureStore) Start(filter *RequestFilter, query string, maxEntries int, maxBody int) *Capture {
+	if maxEntries <= 0 {
+		maxEntries = DefaultCaptureEntries
+	}
+	if maxBody <= 0 {
+		maxBody = DefaultCaptureBody
+	}
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	o.Last++
+	capture := &Capture{
+		ID:         o.Last,
+		Filter:     filter,
+		Query:      query,
+		MaxEntries: maxEntries,
+		MaxBody:    maxBody,
+		Lock:       new(sync.Mutex),
+		Started:    time.Now(),
+	}
+	o.Captures[capture.ID] = capture
+	return capture
+}
+
+func (o *CaptureStore) Get(id int) *Capture {
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	return o.Captures[id]
+}
+
+func (o *CaptureStore) Delete(id int) bool {
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	_, ok := o.Captures[id]
+	delete(o.Captures, id)
+	return ok
+}
+
+// List returns the captures ordered by id
+func (o *CaptureStore) List() []CaptureInfo {
+	o.Lock.Lock()
+	captures := make([]*Capture, 0, len(o.Captures))
+	for _, capture := range o.Captures {
+		captures = append(captures, capture)
+	}
+	o.Lock.Unlock()
+	sort.Slice(captures, func(i, j int) bool {
+		return captures[i].ID < captures[j].ID
+	})
+	infos := make([]CaptureInfo, 0, len(captures))
+	for _, capture := range captures {
+		infos = append(infos, capture.Info())
+	}
+	return infos
+}
+
+// Record adds a finished client to the active captures it matches
+func (o *CaptureStore) Record(client *TCPClient, record *AccessRecord) {
+	o.Lock.Lock()
+	var matching []*Capture
+	for _, capture := range o.Captures {
+		if capture.Filter.Match(record) {
+			matching = append(matching, capture)
+		}
+	}
+	o.Lock.Unlock()
+	for _, capture := range matching {
+		capture.Add(client, record)
+	}
+}
+
+func (o *Capture) Info() CaptureInfo {
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	info := CaptureInfo{
+		ID:         o.ID,
+		Filter:     o.Query,
+		MaxEntries: o.MaxEntries,
+		MaxBody:    o.MaxBody,
+		Started:    o.Started,
+		Entries:    len(o.Entries),
+		Active:     o.Stopped.IsZero(),
+	}
+	if !info.Active {
+		stopped := o.Stopped
+		info.Stopped = &stopped
+	}
+	return info
+}
+
+func (o *Capture) Stop() {
+	o.Lock.Lock()
+	if o.Stopped.IsZero() {
+		o.Stopped = time.Now()
+	}
+	o.Lock.Unlock()
+}
+
+// Add records a client unless the capture is stopped, it stops once full
+func (o *Capture) Add(client *TCPClient, record *AccessRecord) {
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	if !o.Stopped.IsZero() {
+		return
+	}
+	o.Entries = append(o.Entries, CreateHAREntry(client, record, o.MaxBody))
+	if len(o.Entries) >= o.MaxEntries {
+		o.Stopped = time.Now()
+	}
+}
+
+// HAR returns the archive of the entries recorded so far
+func (o *Capture) HAR() *har.HAR {
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	entries := append([]har.Entry{}, o.Entries...)
+	comment := fmt.Sprintf("PrGoxy capture %d", o.ID)
+	if o.Query != "" {
+		comment += " of " + o.Query
+	}
+	return har.Create(entries, comment)
+}
+
+// harContent keeps at most max bytes of a body, as text when it is valid
+// UTF-8 and base64 otherwise
+func harContent(body string, max int) (text string, encoding string, comment string) {
+	if len(body) > max {
+		body = body[:max]
+		comment = fmt.Sprintf("Cut to %d bytes", max)
+	}
+	if utf8.ValidString(body) {
+		return body, "", comment
+	}
+	return base64.StdEncoding.EncodeToString([]byte(body)), "base64", comment
+}
+
+// harQuery lists the query parameters of the request, sorted by name
+func harQuery(client *TCPClient) []har.NameValue {
+	pairs := []har.NameValue{}
+	if client.Request.RequestURI == nil || client.Request.Method == "CONNECT" {
+		return pairs
+	}
+	query := client.Request.RequestURI.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, har.NameValue{Name: k, Value: v})
+		}
+	}
+	return pairs
+}
+
+func harMilliseconds(d time.Duration, applies bool) float64 {
+	if !applies {
+		return -1
+	}
+	return har.Milliseconds(d)
+}
+
+// CreateHAREntry describes the exchange of a finished client
+func CreateHAREntry(client *TCPClient, record *AccessRecord, maxBody int) har.Entry {
+	request := har.Request{
+		Method:      record.Method,
+		URL:         record.URL,
+		HTTPVersion: record.Protocol,
+		Cookies:     []har.NameValue{},
+		Headers:     har.Headers(client.Request.Headers),
+		QueryString: harQuery(client),
+		HeadersSize: -1,
+		BodySize:    len(client.Request.Body),
+	}
+	if client.Request.Body != "" {
+		text, encoding, comment := harContent(client.Request.Body, maxBody)
+		if encoding != "" {
+			text = ""
+			comment = fmt.Sprintf("Binary body of %d bytes omitted", len(client.Request.Body))
+		}
+		request.PostData = &har.PostData{
+			MimeType: client.Request.Headers["Content-Type"],
+			Text:     text,
+			Comment:  comment,
+		}
+	}
+	response := har.Response{
+		Status:      record.Status,
+		Cookies:     []har.NameValue{},
+		Headers:     []har.NameValue{},
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+	if client.Response != nil {
+		r := client.Response
+		text, encoding, comment := harContent(r.Body, maxBody)
+		response.StatusText = r.ReasonPhrase
+		response.HTTPVersion = r.HTTPVersion
+		response.Headers = har.Headers(r.Headers)
+		response.RedirectURL = r.Headers["Location"]
+		response.BodySize = len(r.Body)
+		response.Content = har.Content{
+			Size:     len(r.Body),
+			MimeType: r.Headers["Content-Type"],
+			Text:     text,
+			Encoding: encoding,
+			Comment:  comment,
+		}
+	}
+	// What isn't spent with the upstream server is spent in the proxy. The
+	// TLS handshake with the client comes before the request is read, it is
+	// added to connect as HAR wants ssl to be.
+	total := time.Duration(record.Duration * float64(time.Second))
+	timings := client.Timings
+	upstream := timings.Upstream()
+	secure := timings.TLS > 0
+	blocked := total - timings.DNS - timings.Connect - timings.Send - timings.Wait - timings.Receive
+	if blocked < 0 {
+		blocked = 0
+	}
+	entry := har.Entry{
+		StartedDateTime: record.Time.Add(-timings.TLS),
+		Time:            har.Milliseconds(total + timings.TLS),
+		Request:         request,
+		Response:        response,
+		Timings: har.Timings{
+			Blocked: har.Milliseconds(blocked),
+			DNS:     harMilliseconds(timings.DNS, upstream),
+			Connect: harMilliseconds(timings.Connect+timings.TLS, upstream || secure),
+			Send:    har.Milliseconds(timings.Send),
+			Wait:    har.Milliseconds(timings.Wait),
+			Receive: har.Milliseconds(timings.Receive),
+			SSL:     harMilliseconds(timings.TLS, secure),
+		},
+		Connection: fmt.Sprint(client.ID),
+	}
+	notes := []string{"client " + record.Client}
+	if record.Cache != "" {
+		notes = append(notes, "cache "+record.Cache)
+	}
+	if record.Decision != "" {
+		notes = append(notes, record.Decision)
+	}
+	entry.Comment = strings.Join(notes, ", ")
+	return entry
+}
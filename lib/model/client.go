@@ -4,11 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"net"
-	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/WangYihang/PrGoxy/lib/config"
@@ -29,6 +29,8 @@ type HTTPResponse struct {
 	ReasonPhrase string
 	Headers      map[string]string
 	Body         string
+	// When the response was stored in cache
+	Received time.Time
 }
 
 type TCPClient struct {
@@ -37,9 +39,59 @@ type TCPClient struct {
 	WriteLock *sync.Mutex
 	Server    *TCPServer
 	Request   *HTTPRequest
+	// Config snapshot taken when the client connected, used for the
+	// whole request even if config is reloaded meanwhile
+	Config *config.Config
+	// Policy of the listener the client connected to
+	Policy *config.Policy
+	// Authenticated user, empty if the policy requires none
+	User string
+	// First read error, later reads return nothing. Timeouts leave the
+	// connection open so the caller can answer before closing it.
+	ReadError error
+	// When set, each read pushes the read deadline back by that much, so
+	// that only inactivity times out
+	ReadIdle time.Duration
+	// Gives back the connection's slots of the limits, called once the
+	// client is deleted
+	Release func()
+	// Set for connections the proxy made to upstream servers
+	Upstream bool
+	// Unique among connections, and when the connection was made
+	ID        uint64
+	Connected time.Time
+	// Published for the admin API, and set once killed through it (accessed
+	// atomically)
+	State  ConnectionState
+	Killed int32
+	// For the access log: when the request started, the protocol the
+	// client spoke, the status sent, bytes sent and received (accessed
+	// atomically), how cache answered and what filters or redirects decided
+	Started     time.Time
+	Protocol    string
+	Status      int
+	Sent        int64
+	Received    int64
+	CacheStatus string
+	Decision    string
+	// Response sent to the client, if any, and how the upstream exchange
+	// went, for captures
+	Response *HTTPResponse
+	// Response of the upstream server or the cache the client was answered
+	// from, before ranges and headers of the proxy, for replay archives. Nil
+	// when the proxy made the response up.
+	Original *HTTPResponse
+	Timings  Timings
+	// When the first byte of the response arrived, upstream clients only
+	FirstByte time.Time
+	// Sent to the client and upstream as X-Request-ID, and the trace the
+	// request is part of
+	RequestID string
+	Trace     TraceContext
 }
 
 var Cache map[string]HTTPResponse
+var CacheLock = new(sync.RWMutex)
 
 func init() {
 	if Cache == nil {
@@ -48,6 +100,7 @@ func init() {
 }
 
 func CreateTCPClient(conn net.Conn, server *TCPServer) *TCPClient {
+	cfg := config.Get()
 	return &TCPClient{
 		Conn:      conn,
 		ReadLock:  new(sync.Mutex),
@@ -56,9 +109,24 @@ func CreateTCPClient(conn net.Conn, server *TCPServer) *TCPClient {
 		Request: &HTTPRequest{
 			Headers: make(map[string]string),
 		},
+		Config:    cfg,
+		Policy:    cfg.PolicyOf(server.Listener.Name),
+		Started:   time.Now(),
+		ID:        nextConnectionID(),
+		Connected: time.Now(),
+		State: ConnectionState{
+			Lock:  new(sync.Mutex),
+			State: StateAccepted,
+		},
 	}
 }
+
+// ToString names the client in log lines, with the request id once the
+// request has started
 func (o *TCPClient) ToString() string {
+	if o.RequestID != "" {
+		return o.Conn.RemoteAddr().String() + " [" + o.RequestID + "]"
+	}
 	return o.Conn.RemoteAddr().String()
 }
 
@@ -67,6 +135,23 @@ func (o *TCPClient) ResponseAndAbort(response string) {
 	o.Server.DeleteTCPClient(o)
 }
 
+// Respond sends a response and closes the connection, the status is kept for
+// the access log. The number of bytes sent is returned.
+func (o *TCPClient) Respond(response *HTTPResponse) int {
+	response = o.ClientResponse(response)
+	// HEAD is answered from cached GET responses, without their body
+	if o.Request.Method == "HEAD" && response.Body != "" {
+		headers := *response
+		headers.Body = ""
+		response = &headers
+	}
+	o.Status = response.StatusCode
+	o.Response = response
+	n := o.Write([]byte(BuildHTTPResponse(response)))
+	o.Server.DeleteTCPClient(o)
+	return n
+}
+
 func (o *TCPClient) Close() {
 	log.Debug("Closeing client: %s", o.ToString())
 	o.Conn.Close()
@@ -75,13 +160,14 @@ func (o *TCPClient) Close() {
 func (o *TCPClient) ReadUntil(token string) string {
 	inputBuffer := make([]byte, 1)
 	var outputBuffer bytes.Buffer
+	if o.ReadError != nil {
+		return ""
+	}
 	for {
-		o.ReadLock.Lock()
-		n, err := o.Conn.Read(inputBuffer)
-		o.ReadLock.Unlock()
+		n, err := o.ReadConn(inputBuffer)
 		if err != nil {
-			log.Error("Read from client failed")
-			o.Server.DeleteTCPClient(o)
+			o.ReadFailed(err)
+			o.CountReceived(outputBuffer.Len())
 			return outputBuffer.String()
 		}
 		outputBuffer.Write(inputBuffer[:n])
@@ -91,19 +177,21 @@ func (o *TCPClient) ReadUntil(token string) string {
 		}
 	}
 	log.Debug("%d bytes read from client", len(outputBuffer.String()))
+	o.CountReceived(outputBuffer.Len())
 	return outputBuffer.String()
 }
 
 func (o *TCPClient) ReadUntilClean(token string) string {
 	inputBuffer := make([]byte, 1)
 	var outputBuffer bytes.Buffer
+	if o.ReadError != nil {
+		return ""
+	}
 	for {
-		o.ReadLock.Lock()
-		n, err := o.Conn.Read(inputBuffer)
-		o.ReadLock.Unlock()
+		n, err := o.ReadConn(inputBuffer)
 		if err != nil {
-			log.Error("Read from client failed")
-			o.Server.DeleteTCPClient(o)
+			o.ReadFailed(err)
+			o.CountReceived(outputBuffer.Len())
 			return outputBuffer.String()
 		}
 		outputBuffer.Write(inputBuffer[:n])
@@ -113,6 +201,7 @@ func (o *TCPClient) ReadUntilClean(token string) string {
 		}
 	}
 	log.Debug("%d bytes read from client", len(outputBuffer.String()))
+	o.CountReceived(outputBuffer.Len())
 	return outputBuffer.String()[:len(outputBuffer.String())-len(token)]
 }
 
@@ -120,16 +209,16 @@ func (o *TCPClient) ReadSize(size int) string {
 	if size <= 0 {
 		return ""
 	}
+	if o.ReadError != nil {
+		return ""
+	}
 	readSize := 0
 	inputBuffer := make([]byte, 1)
 	var outputBuffer bytes.Buffer
 	for {
-		o.ReadLock.Lock()
-		n, err := o.Conn.Read(inputBuffer)
-		o.ReadLock.Unlock()
+		n, err := o.ReadConn(inputBuffer)
 		if err != nil {
-			log.Error("Read from client failed")
-			o.Server.DeleteTCPClient(o)
+			o.ReadFailed(err)
 			break
 		}
 		// If read size equals zero, then finish reading
@@ -140,9 +229,70 @@ func (o *TCPClient) ReadSize(size int) string {
 		}
 	}
 	log.Debug("(%d/%d) bytes read from client", len(outputBuffer.String()), size)
+	o.CountReceived(outputBuffer.Len())
 	return outputBuffer.String()
 }
 
+// CountReceived counts bytes read from the connection
+func (o *TCPClient) CountReceived(n int) {
+	atomic.AddInt64(&o.Received, int64(n))
+	BytesTotal.Add(float64(n), "in", o.Peer())
+}
+
+// CountSent counts bytes written to the connection
+func (o *TCPClient) CountSent(n int) {
+	atomic.AddInt64(&o.Sent, int64(n))
+	BytesTotal.Add(float64(n), "out", o.Peer())
+}
+
+func IsTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// ReadFailed records a read error, the client is dropped unless the read
+// timed out
+func (o *TCPClient) ReadFailed(err error) {
+	o.ReadError = err
+	if IsTimeout(err) {
+		log.Debug("Read from %s timed out", o.ToString())
+		return
+	}
+	if atomic.LoadInt32(&o.Killed) == 1 {
+		log.Debug("Connection %s killed", o.ToString())
+	} else {
+		log.Error("Read from client failed")
+	}
+	o.Server.DeleteTCPClient(o)
+}
+
+// ReadConn reads from the connection, pushing the deadline back first if
+// reads time out on inactivity
+func (o *TCPClient) ReadConn(buffer []byte) (int, error) {
+	o.ReadLock.Lock()
+	defer o.ReadLock.Unlock()
+	if o.ReadIdle > 0 {
+		o.Conn.SetReadDeadline(time.Now().Add(o.ReadIdle))
+	}
+	return o.Conn.Read(buffer)
+}
+
+// SetReadIdleTimeout makes reads time out once nothing arrived for timeout
+func (o *TCPClient) SetReadIdleTimeout(timeout time.Duration) {
+	o.ReadIdle = timeout
+	o.Conn.SetReadDeadline(time.Now().Add(timeout))
+}
+
+// SetReadTimeout sets the read deadline timeout from now, zero clears it
+func (o *TCPClient) SetReadTimeout(timeout time.Duration) {
+	o.ReadIdle = 0
+	if timeout == 0 {
+		o.Conn.SetReadDeadline(time.Time{})
+		return
+	}
+	o.Conn.SetReadDeadline(time.Now().Add(timeout))
+}
+
 func (o *TCPClient) Read(timeout time.Duration) (string, bool) {
 	// Set read time out
 	o.Conn.SetReadDeadline(time.Now().Add(timeout))
@@ -155,7 +305,7 @@ func (o *TCPClient) Read(timeout time.Duration) (string, bool) {
 		n, err := o.Conn.Read(inputBuffer)
 		o.ReadLock.Unlock()
 		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			if IsTimeout(err) {
 				isTimeout = true
 			} else {
 				log.Error("Read from client failed")
@@ -171,10 +321,24 @@ func (o *TCPClient) Read(timeout time.Duration) (string, bool) {
 	return outputBuffer.String(), isTimeout
 }
 
+// Writes are split in chunks of that size, each with its own deadline
+const writeChunk = 32 << 10
+
+// Write sends data to the connection, it fails once a chunk can't be written
+// within the body timeout. The number of bytes written is returned.
 func (o *TCPClient) Write(data []byte) int {
 	o.WriteLock.Lock()
-	n, err := o.Conn.Write(data)
+	n := 0
+	var err error
+	for n < len(data) && err == nil {
+		end := min(n+writeChunk, len(data))
+		o.Conn.SetWriteDeadline(time.Now().Add(o.Config.Timeouts.BodyTimeout()))
+		var written int
+		written, err = o.Conn.Write(data[n:end])
+		n += written
+	}
 	o.WriteLock.Unlock()
+	o.CountSent(n)
 	if err != nil {
 		log.Error("Write to client failed")
 		o.Server.DeleteTCPClient(o)
@@ -183,18 +347,39 @@ func (o *TCPClient) Write(data []byte) int {
 	return n
 }
 
-func (o *TCPClient) ParseHTTPRequest() {
+// ParseHTTPRequest reads the request from the client, false means the client
+// has been answered or dropped already
+func (o *TCPClient) ParseHTTPRequest() bool {
 	var err error
-	// Request-Line
+	timeouts := &o.Config.Timeouts
+	// Request-Line, the connection may sit idle until the request starts
+	o.SetReadTimeout(timeouts.IdleTimeout())
 	o.Request.Method = o.ReadUntilClean(" ")
+	if o.ReadError != nil && o.Request.Method == "" {
+		if IsTimeout(o.ReadError) {
+			log.Debug("Client %s idle for %s, closing", o.ToString(), timeouts.IdleTimeout())
+			o.Server.DeleteTCPClient(o)
+		}
+		return false
+	}
+	o.Started = time.Now()
+	o.RequestID = CreateRequestID()
+	// Slow clients must not hold the connection forever
+	o.SetReadTimeout(timeouts.HeaderTimeout())
 	urlString := o.ReadUntilClean(" ")
-	o.Request.RequestURI, err = url.Parse(urlString)
-	if err != nil {
+	if o.Request.Method == "CONNECT" {
+		// Request-URI of CONNECT is an authority, host:port
+		o.Request.RequestURI, err = &url.URL{Host: urlString}, nil
+	} else {
+		o.Request.RequestURI, err = url.Parse(urlString)
+	}
+	if o.ReadError == nil && err != nil {
 		log.Error("Invalid url: %s", urlString)
-		o.ResponseAndAbort("Invalid url")
-		return
+		o.Respond(CreateErrorResponse(400, "Invalid URL"))
+		return false
 	}
 	o.Request.HTTPVersion = o.ReadUntilClean("\r\n")
+	o.Protocol = o.Request.HTTPVersion
 	log.Data("Method: %s (%d)", o.Request.Method, len(o.Request.Method))
 	log.Data("RequestURI: %s", o.Request.RequestURI)
 	log.Data("HTTPVersion: %s", o.Request.HTTPVersion)
@@ -209,10 +394,18 @@ func (o *TCPClient) ParseHTTPRequest() {
 		}
 		delimiter := ":"
 		index := strings.Index(line, delimiter)
+		if index < 0 {
+			// Malformed header
+			continue
+		}
 		headerKey := line[:index]
 		headerValue := LeftStrip(line[index+len(delimiter):])
 		o.Request.Headers[headerKey] = headerValue
 	}
+	if o.ReadError != nil {
+		return o.RequestTimeout("headers")
+	}
+	o.PropagateTrace()
 
 	log.Data("Request Headers: \n\t%s", o.Request.Headers)
 
@@ -220,16 +413,21 @@ func (o *TCPClient) ParseHTTPRequest() {
 	if o.Request.Method == "POST" {
 		contentLength, err := strconv.Atoi(o.Request.Headers["Content-Length"])
 		if err != nil {
-			o.ResponseAndAbort("Invalid Content-Length")
-			return
+			o.Respond(CreateErrorResponse(400, "Invalid Content-Length"))
+			return false
 		}
+		o.SetReadIdleTimeout(timeouts.BodyTimeout())
 		o.Request.Body = o.ReadSize(contentLength)
+		if o.ReadError != nil {
+			return o.RequestTimeout("body")
+		}
 		log.Data("Body: %s", o.Request.Body)
 
 	} else {
 		o.Request.Body = ""
 	}
 	log.Data("Request Body: \n\t%s", o.Request.Body)
+	o.SetReadTimeout(0)
 	// log.Info(
 	// 	"%s %s %s %s",
 	// 	o.Request.Method,
@@ -237,6 +435,49 @@ func (o *TCPClient) ParseHTTPRequest() {
 	// 	o.Request.HTTPVersion,
 	// 	o.Request.Headers["User-Agent"],
 	// )
+	return true
+}
+
+// RequestTimeout answers a client too slow to send its request with 408,
+// clients dropped for another read error are left alone
+func (o *TCPClient) RequestTimeout(part string) bool {
+	if !IsTimeout(o.ReadError) {
+		return false
+	}
+	log.Warn("Client %s timed out sending request %s", o.ToString(), part)
+	o.Respond(CreateErrorResponse(408, "Request Timeout"))
+	return false
+}
+
+// CreateErrorResponse builds a response for errors of the proxy itself, the
+// reason phrase doubles as body
+func CreateErrorResponse(statusCode int, reasonPhrase string) *HTTPResponse {
+	body := reasonPhrase + "\n"
+	return &HTTPResponse{
+		HTTPVersion:  "HTTP/1.0",
+		StatusCode:   statusCode,
+		ReasonPhrase: reasonPhrase,
+		Headers: map[string]string{
+			"Content-Type":   "text/plain",
+			"Content-Length": strconv.Itoa(len(body)),
+		},
+		Body: body,
+	}
+}
+
+// GatewayError answers a request the upstream server failed, 504 if it timed
+// out, 503 if the host is at its connection limit and 502 otherwise
+func (o *TCPClient) GatewayError(host string, port int, err error) {
+	log.Error("Server (%s) is unavailable: %v", net.JoinHostPort(host, strconv.Itoa(port)), err)
+	if err == ErrLimitReached {
+		o.Reject()
+		return
+	}
+	if IsTimeout(err) {
+		o.Respond(CreateErrorResponse(504, "Gateway Timeout"))
+		return
+	}
+	o.Respond(CreateErrorResponse(502, "Bad Gateway"))
 }
 
 func LeftStrip(data string) string {
@@ -251,11 +492,13 @@ func LeftStrip(data string) string {
 	return data[k:]
 }
 
-func (o *TCPClient) ParseHTTPResponse(response *HTTPResponse) {
+// ParseHTTPResponse reads the response to a request of method
+func (o *TCPClient) ParseHTTPResponse(response *HTTPResponse, method string) {
 	// Declare variables
 	var err error
 	// Status-Line
 	response.HTTPVersion = o.ReadUntilClean(" ")
+	o.FirstByte = time.Now()
 	statusCodeString := o.ReadUntilClean(" ")
 	response.StatusCode, err = strconv.Atoi(statusCodeString)
 	if err != nil {
@@ -278,6 +521,10 @@ func (o *TCPClient) ParseHTTPResponse(response *HTTPResponse) {
 		}
 		delimiter := ":"
 		index := strings.Index(line, delimiter)
+		if index < 0 {
+			// Malformed header
+			continue
+		}
 		headerKey := line[:index]
 		headerValue := LeftStrip(line[index+len(delimiter):])
 		response.Headers[headerKey] = headerValue
@@ -285,10 +532,15 @@ func (o *TCPClient) ParseHTTPResponse(response *HTTPResponse) {
 	log.Data("Response Headers: \n\t%s", response.Headers)
 
 	// Body
-	contentLength, err := strconv.Atoi(response.Headers["Content-Length"])
-	if err != nil {
-		log.Error("Invalid Content-Length: %s", err)
-		// SHOULD NOT abort connection between client
+	// Responses like 304 carry no body and no Content-Length, those to HEAD
+	// have the Content-Length of a GET but no body either
+	contentLength := 0
+	if v, ok := response.Headers["Content-Length"]; ok && method != "HEAD" {
+		contentLength, err = strconv.Atoi(v)
+		if err != nil {
+			log.Error("Invalid Content-Length: %s", err)
+			// SHOULD NOT abort connection between client
+		}
 	}
 	if contentLength > 0 {
 		response.Body = o.ReadSize(contentLength)
@@ -298,17 +550,63 @@ func (o *TCPClient) ParseHTTPResponse(response *HTTPResponse) {
 	}
 }
 
-func Pipe(in *TCPClient, out *TCPClient, desc string) {
-	defer in.ResponseAndAbort("")
-	defer out.ResponseAndAbort("")
+// Tunnel is shared by both directions of a tunnel, which is closed once
+// neither has carried data for Idle
+type Tunnel struct {
+	Idle time.Duration
+	// Unix nanoseconds of the last transfer, accessed atomically
+	Last int64
+	// Set by the first direction to finish
+	Closed int32
+}
+
+func CreateTunnel(idle time.Duration) *Tunnel {
+	ActiveTunnels.Add(1)
+	return &Tunnel{
+		Idle: idle,
+		Last: time.Now().UnixNano(),
+	}
+}
+
+func (t *Tunnel) Close() {
+	if atomic.CompareAndSwapInt32(&t.Closed, 0, 1) {
+		ActiveTunnels.Add(-1)
+	}
+}
+
+func (t *Tunnel) Touch() {
+	atomic.StoreInt64(&t.Last, time.Now().UnixNano())
+}
+
+func (t *Tunnel) Idled() bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&t.Last))) >= t.Idle
+}
+
+func Pipe(in *TCPClient, out *TCPClient, desc string, tunnel *Tunnel) {
+	defer tunnel.Close()
+	defer in.Server.DeleteTCPClient(in)
+	defer out.Server.DeleteTCPClient(out)
 	var buffer = make([]byte, 0x4000)
 	for {
+		in.SetReadTimeout(tunnel.Idle)
 		n, err := in.Conn.Read(buffer)
 		if err != nil {
+			if IsTimeout(err) {
+				// The other direction may still be busy
+				if !tunnel.Idled() {
+					continue
+				}
+				log.Debug("[%s] Tunnel idle for %s, closing", desc, tunnel.Idle)
+				break
+			}
 			log.Debug("[%s] Unable to read from input, error: %s\n", desc, err.Error())
 			break
 		}
+		tunnel.Touch()
+		in.CountReceived(n)
+		out.Conn.SetWriteDeadline(time.Now().Add(tunnel.Idle))
 		n, err = out.Conn.Write(buffer[:n])
+		out.CountSent(n)
 		if err != nil {
 			log.Debug("[%s] Unable to write to output, error: %s\n", desc, err.Error())
 			break
@@ -317,49 +615,80 @@ func Pipe(in *TCPClient, out *TCPClient, desc string) {
 }
 
 func (o *TCPClient) HTTPTunnel() {
-	host := GetHostname(o.Request.RequestURI.String())
-	port := GetPort(o.Request.RequestURI.String(), 443)
-	client := ProxyConnectToServer(o, host, port)
-	if client == nil {
-		log.Error("Server (%s:%d) is unavailable", host, port)
-		o.ResponseAndAbort("Server is unavailable")
+	host := GetHostname(o.Request.RequestURI.Host)
+	port := GetPort(o.Request.RequestURI.Host, 443)
+	client, err := ProxyConnectToServer(o, host, port)
+	if err != nil {
+		o.GatewayError(host, port, err)
 		return
 	}
-	log.Info("CONNECT %s:%d", host, port)
+	log.Info("CONNECT %s %s:%d", o.ToString(), host, port)
+	o.Timings.DNS = client.Timings.DNS
+	o.Timings.Connect = client.Timings.Connect
+	o.Status = 200
+	o.SetState(StateTunnel)
 	// HTTP/1.1 200 Connection established
 	response := &HTTPResponse{
 		HTTPVersion:  "HTTP/1.1",
 		StatusCode:   200,
 		ReasonPhrase: "Connection established",
 	}
-	o.Write([]byte(BuildHTTPResponse(response)))
+	o.Write([]byte(BuildHTTPResponse(o.ClientResponse(response))))
 	// Transfer data
-	go Pipe(client, o, "Server -> Client")
-	go Pipe(o, client, "Client -> Server")
+	tunnel := CreateTunnel(o.Config.Timeouts.TunnelTimeout())
+	go Pipe(client, o, "Server -> Client", tunnel)
+	go Pipe(o, client, "Client -> Server", tunnel)
 }
 
 // Only support HTTP/1.0
 // Methods:
-//   HEAD/GET/POST
+//
+//	HEAD/GET/POST
 func (o *TCPClient) PrGoxy() {
 	// Client guard
 	if o.ClientFilterHandler() {
 		return
 	}
-	o.ParseHTTPRequest()
+	o.SetState(StateReading)
+	if !o.ParseHTTPRequest() {
+		return
+	}
+	// Reverse proxy listeners send every request to their upstream
+	if o.Server.Listener.Protocol == config.ProtocolReverse {
+		if o.Request.Method == "CONNECT" {
+			o.Respond(CreateErrorResponse(405, "CONNECT Not Supported"))
+			return
+		}
+		o.Request.RequestURI.Scheme = "http"
+		o.Request.RequestURI.Host = o.Server.Listener.Upstream
+	}
+	// User guard
+	if o.AuthHandler() {
+		return
+	}
 	// Website guard
 	if o.SiteFilterHandler() {
 		return
 	}
+	// Cache invalidation
+	if o.Request.Method == "PURGE" {
+		o.PurgeHandler()
+		return
+	}
 	// Redirect handler
 	o.RedirectHandler()
+	o.SetState(StateProxying)
+	// Replay mode answers from the archive
+	if o.ReplayHandler() {
+		return
+	}
 	// Support for HTTP Tunnel
 	if o.Request.Method == "CONNECT" {
 		o.HTTPTunnel()
 		return
 	}
 	// Cache handler
-	if config.Cfg.Cache && o.CacheHandler() {
+	if o.Policy.Cache && o.CacheHandler() {
 		return
 	}
 	// Proxy handler
@@ -367,57 +696,101 @@ func (o *TCPClient) PrGoxy() {
 }
 
 func (o *TCPClient) ClientFilterHandler() bool {
-	for _, v := range config.Cfg.Block.Hosts {
+	for _, v := range o.Policy.Block.Hosts {
 		// check if host:port starts with host
 		if strings.HasPrefix(o.Conn.RemoteAddr().String(), v) {
 			// blocked
 			log.Warn("Client (%s) is blocked", v)
-			o.ResponseAndAbort("Your IP is blocked")
+			BlockedTotal.Inc("client", v)
+			o.Decision = DecisionBlockedClient
+			o.Respond(CreateErrorResponse(403, "Client Blocked"))
 			return true
 		}
 	}
 	return false
 }
 
-func (o *TCPClient) SiteFilterHandler() bool {
-	for _, v := range config.Cfg.Block.Sites {
-		// Check hostname is blocked, without any port number
-		var host string
-		if o.Request.Method == "CONNECT" {
-			host = strings.ToLower(GetHostname(o.Request.RequestURI.String()))
-		} else {
-			host = o.Request.RequestURI.Hostname()
-		}
+// SiteBlocked returns the block rule matching the requested host, if any
+func (o *TCPClient) SiteBlocked() (string, bool) {
+	// Check hostname is blocked, without any port number
+	host := strings.ToLower(o.Request.RequestURI.Hostname())
+	for _, v := range o.Policy.Block.Sites {
 		if host == strings.ToLower(v) {
-			// blocked
-			log.Warn("Website (%s) is blocked", v)
-			o.ResponseAndAbort("This website is blocked")
-			return true
+			return v, true
 		}
 	}
+	return "", false
+}
+
+func (o *TCPClient) SiteFilterHandler() bool {
+	if v, ok := o.SiteBlocked(); ok {
+		// blocked
+		log.Warn("Website (%s) is blocked", v)
+		BlockedTotal.Inc("site", v)
+		o.Decision = DecisionBlockedSite
+		o.Respond(CreateErrorResponse(403, "Website Blocked"))
+		return true
+	}
 	return false
 }
 
+// AuthHandler asks for credentials when the policy has users, Basic
+// Proxy-Authorization for proxies and Authorization for reverse proxies
+func (o *TCPClient) AuthHandler() bool {
+	// Authenticated by a client certificate of one of the users
+	if len(o.Policy.Auth) == 0 || o.User != "" {
+		return false
+	}
+	requestHeader, challengeHeader, statusCode, reasonPhrase := "Proxy-Authorization", "Proxy-Authenticate", 407, "Proxy Authentication Required"
+	if o.Server.Listener.Protocol == config.ProtocolReverse {
+		requestHeader, challengeHeader, statusCode, reasonPhrase = "Authorization", "WWW-Authenticate", 401, "Unauthorized"
+	}
+	user, password, ok := config.ParseBasicAuth(o.Request.Headers[requestHeader])
+	if ok && o.Policy.Authenticate(user, password) {
+		o.User = user
+		// Credentials are for the proxy only
+		delete(o.Request.Headers, requestHeader)
+		return false
+	}
+	if ok {
+		log.Warn("Client (%s) failed to authenticate as %s", o.ToString(), user)
+	}
+	o.Decision = DecisionUnauthorized
+	o.Respond(&HTTPResponse{
+		HTTPVersion:  "HTTP/1.0",
+		StatusCode:   statusCode,
+		ReasonPhrase: reasonPhrase,
+		Headers: map[string]string{
+			challengeHeader:  "Basic realm=\"PrGoxy\"",
+			"Content-Length": "0",
+		},
+	})
+	return true
+}
+
 func GetHostname(host string) string {
-	return strings.Split(host, ":")[0]
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		return hostname
+	}
+	return strings.Trim(host, "[]")
 }
 
-func GetPort(host string, default_port int16) int16 {
-	pair := strings.Split(host, ":")
-	if len(pair) < 2 {
+func GetPort(host string, default_port int) int {
+	_, portString, err := net.SplitHostPort(host)
+	if err != nil {
 		return default_port
 	}
-	port, err := strconv.Atoi(pair[len(pair)-1])
+	port, err := strconv.Atoi(portString)
 	if err != nil {
 		return default_port
 	}
-	return int16(port)
+	return port
 }
 
 func (o *TCPClient) RedirectHandler() {
 	// Parse port in Request-URI
 	// Check redirect table
-	for k, v := range config.Cfg.Redirect {
+	for k, v := range o.Policy.Redirect {
 		srcHostname := GetHostname(o.Request.RequestURI.Host)
 		srcPort := GetPort(o.Request.RequestURI.Host, 80)
 		dstHostname := GetHostname(k)
@@ -429,11 +802,8 @@ func (o *TCPClient) RedirectHandler() {
 		log.Debug("target: %s:%d", targetHostname, targetPort)
 		if srcHostname == dstHostname && srcPort == dstPort {
 			log.Success("Redirect %s => %s", k, v)
-			target := fmt.Sprintf(
-				"%s:%d",
-				targetHostname,
-				targetPort,
-			)
+			target := net.JoinHostPort(targetHostname, strconv.Itoa(targetPort))
+			o.Decision = DecisionRedirected + " " + target
 			// Change RequestURI
 			o.Request.RequestURI.Host = target
 			// Change Host
@@ -442,11 +812,15 @@ func (o *TCPClient) RedirectHandler() {
 	}
 }
 
+// Requests carrying Range are never stored, CacheHandler answers them from
+// full objects only
 func Cachable(request *HTTPRequest) bool {
 	return (request.Method == "GET" || request.Method == "HEAD") && request.Headers["Range"] == ""
 }
 
 func CacheHit(uri string) (bool, HTTPResponse) {
+	CacheLock.RLock()
+	defer CacheLock.RUnlock()
 	for k, v := range Cache {
 		if k == uri {
 			return true, v
@@ -455,117 +829,221 @@ func CacheHit(uri string) (bool, HTTPResponse) {
 	return false, HTTPResponse{}
 }
 
+// CacheStore keeps the response of uri, responses cache may not keep drop
+// the entry held so far
+func CacheStore(uri string, response *HTTPResponse) {
+	if !response.Storable() {
+		CacheLock.Lock()
+		delete(Cache, uri)
+		CacheLock.Unlock()
+		return
+	}
+	entry := *response
+	if entry.Received.IsZero() {
+		entry.Received = time.Now()
+	}
+	CacheLock.Lock()
+	Cache[uri] = entry
+	CacheLock.Unlock()
+}
+
 // func IfModifiedSince(request HTTPRequest, lastModified string) {}
 
 func (o *TCPClient) CacheHandler() bool {
+	// Range requests are served from objects we hold in full, the range is
+	// applied after revalidation so the origin is asked for the whole object
+	rangeHeader := o.Request.Headers["Range"]
+	ifRange := o.Request.Headers["If-Range"]
+	if rangeHeader != "" && o.Request.Method == "GET" {
+		ok, response := CacheHit(o.Request.RequestURI.String())
+		if !ok || response.StatusCode != 200 {
+			return false
+		}
+		delete(o.Request.Headers, "Range")
+		delete(o.Request.Headers, "If-Range")
+	}
 	if !Cachable(o.Request) {
 		return false
 	}
-	var err error
-	if ok, response := CacheHit(o.Request.RequestURI.String()); ok {
-		// Send If-Modify-Since
-		ifModifySince := time.Time{}
-		if v, ok := response.Headers["Last-Modified"]; ok {
-			ifModifySince, err = http.ParseTime(v)
-			if err != nil {
-				log.Debug("Failed to parse time, %s", err)
-			}
-		} else if v, ok := response.Headers["Date"]; ok {
-			ifModifySince, err = http.ParseTime(v)
-			if err != nil {
-				log.Debug("Failed to parse time, %s", err)
-			}
-		} else {
-			ifModifySince = time.Now()
+	uri := o.Request.RequestURI.String()
+	ok, response := CacheHit(uri)
+	if !ok {
+		return false
+	}
+	staleness := response.Staleness()
+	whileRevalidate, ifError := response.StaleWindows(o.Config)
+	// Still fresh, no need to ask the server
+	if staleness <= 0 {
+		o.CacheStatus = CacheStatusHit
+		o.Original = &response
+		n := o.Respond(RangeResponse(&response, rangeHeader, ifRange))
+		log.Info("%s %s %s [CACHE][%d][Fresh]", o.Request.Method, o.ToString(), o.Request.RequestURI, n)
+		return true
+	}
+	// Serve the stale copy at once and refresh it afterwards
+	if staleness <= whileRevalidate {
+		o.CacheStatus = CacheStatusStale
+		o.Original = &response
+		n := o.Respond(RangeResponse(response.WithWarning(WarningStale), rangeHeader, ifRange))
+		log.Info("%s %s %s [CACHE][%d][Stale-While-Revalidate]", o.Request.Method, o.ToString(), o.Request.RequestURI, n)
+		go RevalidateInBackground(o, CopyHTTPRequest(o.Request), response)
+		return true
+	}
+	ifModifySinceResponse, notModified := Revalidate(o, o.Request, &response, &o.Timings)
+	if ifModifySinceResponse == nil || ifModifySinceResponse.StatusCode >= 500 {
+		// Server is down or failing, fall back to the stale copy if allowed
+		if staleness <= ifError {
+			o.CacheStatus = CacheStatusStale
+			o.Original = &response
+			n := o.Respond(RangeResponse(response.WithWarning(WarningRevalidateFailed), rangeHeader, ifRange))
+			log.Info("%s %s %s [CACHE][%d][Stale-If-Error]", o.Request.Method, o.ToString(), o.Request.RequestURI, n)
+			return true
 		}
-		// Connect to server
-		host := GetHostname(o.Request.RequestURI.Host)
-		port := GetPort(o.Request.RequestURI.Host, 80)
-		client := ProxyConnectToServer(o, host, port)
-		if client == nil {
+		if ifModifySinceResponse == nil {
 			// false represents that proxy handler does not handle the request
 			return false
 		}
-
-		o.Request.Headers["If-Modified-Since"] = ifModifySince.Format(time.RFC1123)
-		client.Write([]byte(BuildHTTPRequest(o.Request)))
-		ifModifySinceResponse := &HTTPResponse{
-			Headers: make(map[string]string),
-		}
-		client.ParseHTTPResponse(ifModifySinceResponse)
-		// If 304 Not Modified
-		//     Send cache
-		// Else
-		//     Save to cache
-		statusCode := ifModifySinceResponse.StatusCode
-		if statusCode == 304 {
-			responseData := BuildHTTPResponse(&response)
-			o.ResponseAndAbort(responseData)
-			log.Warn("%s %s %s [CACHE][%d][Not-Modified]", o.Request.Method, o.ToString(), o.Request.RequestURI, len(responseData))
-		} else {
-			// Need refresh cache
-			responseData := BuildHTTPResponse(ifModifySinceResponse)
-			o.ResponseAndAbort(responseData)
-			log.Warn("%s %s %s [CACHE][%d][Renovation]", o.Request.Method, o.ToString(), o.Request.RequestURI, len(responseData))
-			// refresh cache
-			Cache[o.Request.RequestURI.String()] = *ifModifySinceResponse
-		}
-		return true
 	}
-	return false
+	// If 304 Not Modified
+	//     Send cache
+	// Else
+	//     Save to cache
+	o.Original = ifModifySinceResponse
+	if notModified {
+		o.CacheStatus = CacheStatusRevalidated
+		n := o.Respond(RangeResponse(ifModifySinceResponse, rangeHeader, ifRange))
+		log.Info("%s %s %s [CACHE][%d][Not-Modified]", o.Request.Method, o.ToString(), o.Request.RequestURI, n)
+	} else {
+		// Need refresh cache
+		o.CacheStatus = CacheStatusMiss
+		n := o.Respond(RangeResponse(ifModifySinceResponse, rangeHeader, ifRange))
+		log.Info("%s %s %s [CACHE][%d][Renovation]", o.Request.Method, o.ToString(), o.Request.RequestURI, n)
+	}
+	// refresh cache, server errors keep the old entry so the next request
+	// tries the origin again. A HEAD response has no body to keep.
+	if ifModifySinceResponse.StatusCode < 500 && (notModified || o.Request.Method == "GET") {
+		CacheStore(uri, ifModifySinceResponse)
+	}
+	return true
 }
 
-func ProxyConnectToServer(o *TCPClient, host string, port int16) *TCPClient {
-	var err error
-	target := fmt.Sprintf("%s:%d",
-		host,
-		port,
-	)
-	log.Debug("Connecting to %s", target)
-	conn, err := net.Dial(
-		"tcp",
-		target,
-	)
+func ProxyConnectToServer(o *TCPClient, host string, port int) (*TCPClient, error) {
+	release, err := AdmitHost(o, host)
+	if err != nil {
+		UpstreamConnectErrors.Inc(connectError(err))
+		return nil, err
+	}
+	log.Debug("Connecting to %s", net.JoinHostPort(host, strconv.Itoa(port)))
+	started := time.Now()
+	conn, timings, err := DialUpstream(host, port, o.Config.Timeouts.DialTimeout())
 	if err != nil {
-		return nil
+		release()
+		UpstreamConnectErrors.Inc(connectError(err))
+		return nil, err
 	}
+	UpstreamConnectSeconds.Observe(time.Since(started).Seconds())
 	client := CreateTCPClient(conn, o.Server)
+	client.Upstream = true
+	client.Release = release
+	// How resolving and connecting went, for the client to take over
+	client.Timings = timings
+	client.SetState(StateUpstream)
 	o.Server.AddTCPClient(client)
-	return client
+	return client, nil
+}
+
+// FetchFromServer sends the client's request upstream
+func (o *TCPClient) FetchFromServer(host string, port int) (*HTTPResponse, error) {
+	return o.Exchange(host, port, o.Request, &o.Timings)
+}
+
+// Exchange sends a request upstream on behalf of the client, the whole
+// response must arrive within the body timeout. Each step is timed into
+// timings unless nil.
+func (o *TCPClient) Exchange(host string, port int, request *HTTPRequest, timings *Timings) (*HTTPResponse, error) {
+	requestData := BuildHTTPRequest(request)
+	log.Data("Rewrited Request: \n%s", requestData)
+	client, err := ProxyConnectToServer(o, host, port)
+	if err != nil {
+		return nil, err
+	}
+	defer o.Server.DeleteTCPClient(client)
+	connected := time.Now()
+	// Send request to server
+	client.Write([]byte(requestData))
+	sent := time.Now()
+	// Parse server response
+	response := &HTTPResponse{
+		Headers: make(map[string]string),
+	}
+	client.SetReadIdleTimeout(o.Config.Timeouts.BodyTimeout())
+	client.ParseHTTPResponse(response, request.Method)
+	if timings != nil {
+		firstByte := client.FirstByte
+		if firstByte.IsZero() {
+			firstByte = time.Now()
+		}
+		// The handshake with the client is kept
+		timings.DNS = client.Timings.DNS
+		timings.Connect = client.Timings.Connect
+		timings.Send = sent.Sub(connected)
+		timings.Wait = firstByte.Sub(sent)
+		timings.Receive = time.Since(firstByte)
+	}
+	if client.ReadError != nil {
+		return nil, client.ReadError
+	}
+	return response, nil
 }
 
 func (o *TCPClient) ProxyHandler() {
 	// Construct HTTP Request
 	// Force HTTP/1.0
 	o.Request.HTTPVersion = "HTTP/1.0"
-	requestData := BuildHTTPRequest(o.Request)
-	log.Data("Rewrited Request: \n%s", requestData)
 	// Connect to server
 	host := GetHostname(o.Request.RequestURI.Host)
 	port := GetPort(o.Request.RequestURI.Host, 80)
 
-	client := ProxyConnectToServer(o, host, port)
-	if client == nil {
-		log.Error("Server (%s:%d) is unavailable", host, port)
-		o.ResponseAndAbort("Server is unavailable")
-		return
+	var response *HTTPResponse
+	var err error
+	if o.Policy.Cache && Cachable(o.Request) {
+		o.CacheStatus = CacheStatusMiss
+		// Concurrent misses on the same method and uri share one upstream
+		// request, the response is cached before the waiters are released.
+		// Only the client doing the request learns why it failed. Entries
+		// are kept by uri only, so HEAD responses without a body aren't.
+		uri := o.Request.RequestURI.String()
+		var shared bool
+		response, shared = Flights.Do(o.Request.Method+" "+uri, func() *HTTPResponse {
+			var response *HTTPResponse
+			response, err = o.FetchFromServer(host, port)
+			if response != nil && o.Request.Method == "GET" {
+				CacheStore(uri, response)
+			}
+			return response
+		})
+		// A private response is only for the client that asked for it
+		if shared && response != nil && !response.Shareable() {
+			response, err = o.FetchFromServer(host, port)
+		}
+	} else {
+		// Partial and non-idempotent responses must not end up in the cache
+		response, err = o.FetchFromServer(host, port)
 	}
-	// Send request to server
-	client.Write([]byte(requestData))
-	// Parse server response
-	response := &HTTPResponse{
-		Headers: make(map[string]string),
+	if response == nil {
+		o.GatewayError(host, port, err)
+		return
 	}
-	client.ParseHTTPResponse(response)
+	o.Original = response
 	// Build response
+	response = o.ClientResponse(response)
 	responseData := BuildHTTPResponse(response)
-	log.Data(responseData)
+	log.Data("%s", responseData)
 	// Send response data to client
+	o.Status = response.StatusCode
+	o.Response = response
 	o.ResponseAndAbort(responseData)
 
-	// Cache
-	Cache[o.Request.RequestURI.String()] = *response
-
 	// Log
 	log.Info("%s %s %s [%d][%d]", o.Request.Method, o.ToString(), o.Request.RequestURI, response.StatusCode, len(responseData))
 }
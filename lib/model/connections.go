@@ -0,0 +1,118 @@
+package model
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What a connection is doing
+const (
+	StateAccepted = "accepted"
+	StateReading  = "reading"
+	StateProxying = "proxying"
+	StateTunnel   = "tunnel"
+	StateUpstream = "upstream"
+)
+
+// Last id given to a connection
+var lastConnectionID uint64
+
+func nextConnectionID() uint64 {
+	return atomic.AddUint64(&lastConnectionID, 1)
+}
+
+// ConnectionInfo describes a live connection to operators
+type ConnectionInfo struct {
+	ID       uint64    `json:"id"`
+	Listener string    `json:"listener"`
+	Peer     string    `json:"peer"`
+	Kind     string    `json:"kind"`
+	User     string    `json:"user,omitempty"`
+	Method   string    `json:"method,omitempty"`
+	Target   string    `json:"target,omitempty"`
+	State    string    `json:"state"`
+	Started  time.Time `json:"started"`
+	Sent     int64     `json:"sent"`
+	Received int64     `json:"received"`
+}
+
+// ConnectionState is what the connection's own goroutine publishes about it,
+// it is read by others under the lock
+type ConnectionState struct {
+	Lock   *sync.Mutex
+	State  string
+	User   string
+	Method string
+	Target string
+}
+
+// SetState publishes what the client is doing, along with the user and
+// target known so far. Only the client's own goroutine calls it.
+func (o *TCPClient) SetState(state string) {
+	target := ""
+	if o.Request.RequestURI != nil {
+		target = o.Request.RequestURI.Host
+	}
+	o.State.Lock.Lock()
+	o.State.State = state
+	o.State.User = o.User
+	o.State.Method = o.Request.Method
+	o.State.Target = target
+	o.State.Lock.Unlock()
+}
+
+func (o *TCPClient) Info() ConnectionInfo {
+	o.State.Lock.Lock()
+	defer o.State.Lock.Unlock()
+	info := ConnectionInfo{
+		ID:       o.ID,
+		Listener: o.Server.Listener.Name,
+		Peer:     o.Conn.RemoteAddr().String(),
+		Kind:     o.Peer(),
+		User:     o.State.User,
+		Method:   o.State.Method,
+		Target:   o.State.Target,
+		State:    o.State.State,
+		Started:  o.Connected,
+		Sent:     atomic.LoadInt64(&o.Sent),
+		Received: atomic.LoadInt64(&o.Received),
+	}
+	if o.Upstream {
+		info.Target = info.Peer
+	}
+	return info
+}
+
+// Connections lists the connections of the given servers, ordered by id
+func Connections(servers []*TCPServer) []ConnectionInfo {
+	var connections []ConnectionInfo
+	for _, server := range servers {
+		for _, client := range server.ClientList() {
+			connections = append(connections, client.Info())
+		}
+	}
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].ID < connections[j].ID
+	})
+	return connections
+}
+
+// FindConnection looks a connection up by id in the given servers
+func FindConnection(servers []*TCPServer, id uint64) *TCPClient {
+	for _, server := range servers {
+		if client := server.Find(id); client != nil {
+			return client
+		}
+	}
+	return nil
+}
+
+// Kill closes a connection from outside its goroutine. Whatever the goroutine
+// was doing fails, it then cleans up and records the request as usual.
+// Closing a tunnel's client ends the tunnel.
+func (o *TCPClient) Kill() {
+	atomic.StoreInt32(&o.Killed, 1)
+	o.Conn.Close()
+}
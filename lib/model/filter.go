@@ -0,0 +1,158 @@
+package model
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// RequestFilter selects access records. Each set of values matches when
+// any of its values does, empty sets match everything.
+type RequestFilter struct {
+	// Client addresses and networks
+	Clients []*net.IPNet
+	// Hostnames, *.example.com matches the subdomains of example.com
+	Hosts    []string
+	Methods  []string
+	Statuses []StatusRange
+}
+
+// StatusRange is an inclusive range of status codes
+type StatusRange struct {
+	Min int
+	Max int
+}
+
+// values splits the comma separated values of a repeated parameter
+func values(query url.Values, key string) []string {
+	var result []string
+	for _, v := range query[key] {
+		for _, value := range strings.Split(v, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				result = append(result, value)
+			}
+		}
+	}
+	return result
+}
+
+// CreateRequestFilter reads a filter from query parameters, each can be
+// repeated or hold comma separated values
+//
+//	client=10.0.0.1,10.1.0.0/16
+//	host=example.com,*.example.org
+//	status=404,5xx,200-299
+//	method=GET,POST
+func CreateRequestFilter(query url.Values) (*RequestFilter, error) {
+	filter := &RequestFilter{}
+	for _, v := range values(query, "client") {
+		cidr := v
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid client: %q", v)
+		}
+		filter.Clients = append(filter.Clients, network)
+	}
+	for _, v := range values(query, "host") {
+		filter.Hosts = append(filter.Hosts, strings.ToLower(v))
+	}
+	for _, v := range values(query, "method") {
+		filter.Methods = append(filter.Methods, strings.ToUpper(v))
+	}
+	for _, v := range values(query, "status") {
+		statusRange, err := ParseStatusRange(v)
+		if err != nil {
+			return nil, err
+		}
+		filter.Statuses = append(filter.Statuses, statusRange)
+	}
+	return filter, nil
+}
+
+// ParseStatusRange reads 404, 4xx or 400-499
+func ParseStatusRange(s string) (StatusRange, error) {
+	invalid := fmt.Errorf("Invalid status: %q", s)
+	if len(s) == 3 && strings.HasSuffix(strings.ToLower(s), "xx") {
+		class, err := strconv.Atoi(s[:1])
+		if err != nil || class < 1 || class > 5 {
+			return StatusRange{}, invalid
+		}
+		return StatusRange{class * 100, class*100 + 99}, nil
+	}
+	bounds := strings.SplitN(s, "-", 2)
+	min, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return StatusRange{}, invalid
+	}
+	max := min
+	if len(bounds) == 2 {
+		max, err = strconv.Atoi(bounds[1])
+		if err != nil || max < min {
+			return StatusRange{}, invalid
+		}
+	}
+	return StatusRange{min, max}, nil
+}
+
+func (o *RequestFilter) Match(r *AccessRecord) bool {
+	if len(o.Clients) > 0 {
+		ip := net.ParseIP(r.Client)
+		match := false
+		for _, network := range o.Clients {
+			if ip != nil && network.Contains(ip) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+	if len(o.Hosts) > 0 {
+		host := strings.ToLower(r.Host())
+		match := false
+		for _, v := range o.Hosts {
+			if host == v || strings.HasPrefix(v, "*.") && strings.HasSuffix(host, v[1:]) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+	if len(o.Methods) > 0 {
+		match := false
+		for _, v := range o.Methods {
+			if r.Method == v {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+	if len(o.Statuses) > 0 {
+		match := false
+		for _, v := range o.Statuses {
+			if r.Status >= v.Min && r.Status <= v.Max {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,67 @@
+package model
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseStatusRange(t *testing.T) {
+	tests := []struct {
+		s    string
+		want StatusRange
+		err  bool
+	}{
+		{"404", StatusRange{404, 404}, false},
+		{"5xx", StatusRange{500, 599}, false},
+		{"2XX", StatusRange{200, 299}, false},
+		{"200-299", StatusRange{200, 299}, false},
+		{"301-301", StatusRange{301, 301}, false},
+		{"0xx", StatusRange{}, true},
+		{"6xx", StatusRange{}, true},
+		{"xxx", StatusRange{}, true},
+		{"299-200", StatusRange{}, true},
+		{"200-", StatusRange{}, true},
+		{"ok", StatusRange{}, true},
+		{"", StatusRange{}, true},
+	}
+	for _, test := range tests {
+		got, err := ParseStatusRange(test.s)
+		if (err != nil) != test.err {
+			t.Errorf("ParseStatusRange(%q) error = %v, want error %v", test.s, err, test.err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseStatusRange(%q) = %v, want %v", test.s, got, test.want)
+		}
+	}
+}
+
+func TestRequestFilterMatch(t *testing.T) {
+	query := url.Values{
+		"client": {"10.0.0.1,10.1.0.0/16"},
+		"host":   {"example.com,*.example.org"},
+		"status": {"404", "5xx"},
+		"method": {"get"},
+	}
+	filter, err := CreateRequestFilter(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		record AccessRecord
+		match  bool
+	}{
+		{"exact", AccessRecord{Client: "10.0.0.1", URL: "http://example.com/", Status: 404, Method: "GET"}, true},
+		{"network and subdomain", AccessRecord{Client: "10.1.2.3", URL: "http://a.example.org/", Status: 503, Method: "GET"}, true},
+		{"other client", AccessRecord{Client: "10.0.0.2", URL: "http://example.com/", Status: 404, Method: "GET"}, false},
+		{"other host", AccessRecord{Client: "10.0.0.1", URL: "http://example.net/", Status: 404, Method: "GET"}, false},
+		{"other status", AccessRecord{Client: "10.0.0.1", URL: "http://example.com/", Status: 200, Method: "GET"}, false},
+		{"other method", AccessRecord{Client: "10.0.0.1", URL: "http://example.com/", Status: 404, Method: "POST"}, false},
+	}
+	for _, test := range tests {
+		if got := filter.Match(&test.record); got != test.match {
+			t.Errorf("%s: Match = %v, want %v", test.name, got, test.match)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package model
+
+import (
+	"sync"
+
+	"github.com/WangYihang/PrGoxy/lib/util/log"
+)
+
+// Flight is an upstream fetch in progress, other clients asking for the
+// same resource wait on it instead of dialing the server themselves
+type Flight struct {
+	Done     *sync.WaitGroup
+	Response *HTTPResponse
+	Waiters  int
+}
+
+type FlightGroup struct {
+	Lock    *sync.Mutex
+	Flights map[string]*Flight
+}
+
+var Flights = CreateFlightGroup()
+
+func CreateFlightGroup() *FlightGroup {
+	return &FlightGroup{
+		Lock:    new(sync.Mutex),
+		Flights: map[string]*Flight{},
+	}
+}
+
+// Do calls fetch once for each key at a time, concurrent callers with the
+// same key block until the first one finishes and get the same response.
+// shared is true if the response was fetched by another caller.
+func (g *FlightGroup) Do(key string, fetch func() *HTTPResponse) (response *HTTPResponse, shared bool) {
+	g.Lock.Lock()
+	if flight, ok := g.Flights[key]; ok {
+		flight.Waiters++
+		g.Lock.Unlock()
+		flight.Done.Wait()
+		return flight.Response, true
+	}
+	flight := &Flight{
+		Done: new(sync.WaitGroup),
+	}
+	flight.Done.Add(1)
+	g.Flights[key] = flight
+	g.Lock.Unlock()
+
+	flight.Response = fetch()
+
+	g.Lock.Lock()
+	delete(g.Flights, key)
+	g.Lock.Unlock()
+	flight.Done.Done()
+	if flight.Waiters > 0 {
+		log.Debug("%d request(s) collapsed into %s", flight.Waiters, key)
+	}
+	return flight.Response, false
+}
@@ -0,0 +1,146 @@
+package model
+
+import (
+	"strconv"
+
+	"github.com/WangYihang/PrGoxy/lib/metrics"
+)
+
+var (
+	RequestsTotal = metrics.CreateCounter(
+		"prgoxy_requests_total",
+		"Requests answered, by method, status and cache result",
+		"method", "status", "cache",
+	)
+	BytesTotal = metrics.CreateCounter(
+		"prgoxy_bytes_total",
+		"Bytes received from (in) and sent to (out) clients and upstream servers",
+		"direction", "peer",
+	)
+	UpstreamConnectSeconds = metrics.CreateHistogram(
+		"prgoxy_upstream_connect_seconds",
+		"Time taken to connect to upstream servers",
+		metrics.DefaultBuckets,
+	)
+	UpstreamConnectErrors = metrics.CreateCounter(
+		"prgoxy_upstream_connect_errors_total",
+		"Failed upstream connections, by reason: timeout, limit or error",
+		"reason",
+	)
+	ActiveConnections = metrics.CreateGauge(
+		"prgoxy_connections",
+		"Open client connections, by listener",
+		"listener",
+	)
+	ActiveTunnels = metrics.CreateGauge(
+		"prgoxy_tunnels",
+		"Open CONNECT and SOCKS tunnels",
+	)
+	CacheEntriesGauge = metrics.CreateGaugeFunc(
+		"prgoxy_cache_entries",
+		"Responses in cache",
+		func() float64 {
+			CacheLock.RLock()
+			defer CacheLock.RUnlock()
+			return float64(len(Cache))
+		},
+	)
+	CacheBytesGauge = metrics.CreateGaugeFunc(
+		"prgoxy_cache_bytes",
+		"Size of the response bodies in cache",
+		func() float64 {
+			CacheLock.RLock()
+			defer CacheLock.RUnlock()
+			size := 0
+			for _, v := range Cache {
+				size += len(v.Body)
+			}
+			return float64(size)
+		},
+	)
+	CacheEvictions = metrics.CreateCounter(
+		"prgoxy_cache_evictions_total",
+		"Responses removed from cache",
+	)
+	BlockedTotal = metrics.CreateCounter(
+		"prgoxy_blocked_requests_total",
+		"Requests blocked, by kind (client or site) and rule",
+		"kind", "rule",
+	)
+	RequestPhaseSeconds = metrics.CreateHistogram(
+		"prgoxy_request_phase_seconds",
+		"Time spent in each phase of requests: client-tls, dns, connect, send, ttfb or transfer",
+		metrics.DefaultBuckets,
+		"phase",
+	)
+	SpansTotal = metrics.CreateCounter(
+		"prgoxy_spans_total",
+		"Spans handed to the trace collector, by result: exported, failed or dropped",
+		"result",
+	)
+)
+
+// Peer tells clients from connections the proxy made to upstream servers
+func (o *TCPClient) Peer() string {
+	if o.Upstream {
+		return "upstream"
+	}
+	return "client"
+}
+
+// Methods counted under their own name, clients choose the method so any
+// other is counted as OTHER to keep the number of series bounded
+var metricMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"POST":    true,
+	"PUT":     true,
+	"DELETE":  true,
+	"CONNECT": true,
+	"OPTIONS": true,
+	"TRACE":   true,
+	"PATCH":   true,
+	"PURGE":   true,
+}
+
+func metricMethod(method string) string {
+	if method == "" {
+		return "NONE"
+	}
+	if !metricMethods[method] {
+		return "OTHER"
+	}
+	return method
+}
+
+// metricStatus bounds the status label the same way, upstream servers may
+// answer with any number
+func metricStatus(status int) string {
+	if status != 0 && (status < 100 || status > 599) {
+		return "OTHER"
+	}
+	return strconv.Itoa(status)
+}
+
+// CountRequest records a finished client in the request metrics
+func CountRequest(o *TCPClient) {
+	cache := o.CacheStatus
+	if cache == "" {
+		cache = "NONE"
+	}
+	RequestsTotal.Inc(metricMethod(o.Request.Method), metricStatus(o.Status), cache)
+	for _, phase := range o.Timings.Phases() {
+		RequestPhaseSeconds.Observe(phase.Duration.Seconds(), phase.Name)
+	}
+}
+
+// connectError names the reason an upstream connection failed
+func connectError(err error) string {
+	if err == ErrLimitReached {
+		return "limit"
+	}
+	if IsTimeout(err) {
+		return "timeout"
+	}
+	return "error"
+}
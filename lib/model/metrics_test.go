@@ -0,0 +1,31 @@
+package model
+
+import "testing"
+
+func TestMetricLabels(t *testing.T) {
+	methods := map[string]string{
+		"":         "NONE",
+		"GET":      "GET",
+		"PURGE":    "PURGE",
+		"get":      "OTHER",
+		"X7f3a9c1": "OTHER",
+	}
+	for method, want := range methods {
+		if got := metricMethod(method); got != want {
+			t.Errorf("metricMethod(%q) = %q, want %q", method, got, want)
+		}
+	}
+	statuses := map[int]string{
+		0:         "0",
+		200:       "200",
+		599:       "599",
+		99:        "OTHER",
+		600:       "OTHER",
+		123456789: "OTHER",
+	}
+	for status, want := range statuses {
+		if got := metricStatus(status); got != want {
+			t.Errorf("metricStatus(%d) = %q, want %q", status, got, want)
+		}
+	}
+}
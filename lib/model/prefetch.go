@@ -0,0 +1,88 @@
+package model
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/WangYihang/PrGoxy/lib/config"
+	"github.com/WangYihang/PrGoxy/lib/util/log"
+)
+
+type PrefetchResult struct {
+	URL    string `json:"url"`
+	Status int    `json:"status"`
+	Size   int    `json:"size"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Prefetch fetches a url into cache the same way ProxyHandler handles a miss
+func (o *TCPServer) Prefetch(uri string) PrefetchResult {
+	result := PrefetchResult{URL: uri}
+	requestURI, err := url.Parse(uri)
+	if err != nil || requestURI.Host == "" || requestURI.Scheme != "http" {
+		result.Error = "Invalid url"
+		return result
+	}
+	// A client without a connection, only the request and server are used
+	client := &TCPClient{
+		Server: o,
+		Config: config.Get(),
+		Request: &HTTPRequest{
+			Method:      "GET",
+			RequestURI:  requestURI,
+			HTTPVersion: "HTTP/1.0",
+			Headers: map[string]string{
+				"Host": requestURI.Host,
+			},
+		},
+	}
+	host := GetHostname(requestURI.Host)
+	port := GetPort(requestURI.Host, 80)
+	var fetchErr error
+	response, _ := Flights.Do(client.Request.Method+" "+requestURI.String(), func() *HTTPResponse {
+		var response *HTTPResponse
+		response, fetchErr = client.FetchFromServer(host, port)
+		if response != nil {
+			CacheStore(requestURI.String(), response)
+		}
+		return response
+	})
+	if response == nil {
+		result.Error = fmt.Sprintf("Server (%s:%d) is unavailable", host, port)
+		if fetchErr != nil {
+			result.Error += ": " + fetchErr.Error()
+		}
+		return result
+	}
+	result.Status = response.StatusCode
+	result.Size = len(response.Body)
+	return result
+}
+
+// PrefetchAll warms the cache with a list of urls, at most concurrency of
+// them are fetched at the same time. Results keep the order of urls.
+func (o *TCPServer) PrefetchAll(urls []string, concurrency int) []PrefetchResult {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	results := make([]PrefetchResult, len(urls))
+	slots := make(chan struct{}, concurrency)
+	wg := new(sync.WaitGroup)
+	for i, uri := range urls {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, uri string) {
+			defer wg.Done()
+			results[i] = o.Prefetch(uri)
+			<-slots
+			if results[i].Error != "" {
+				log.Warn("Prefetch %s failed: %s", uri, results[i].Error)
+			} else {
+				log.Info("Prefetch %s [%d][%d]", uri, results[i].Status, results[i].Size)
+			}
+		}(i, uri)
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,223 @@
+package model
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/WangYihang/PrGoxy/lib/util/log"
+)
+
+type ByteRange struct {
+	Start int
+	End   int
+}
+
+var ErrRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// Most ranges a request may ask for, more are ignored as a whole
+const maxRanges = 16
+
+func (r ByteRange) ContentRange(size int) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.End, size)
+}
+
+// ParseRange parses a Range header (RFC 7233) against an object of the given
+// size, ranges which start past the end of the object are dropped and the
+// others are sorted and merged when they overlap or touch. As RFC 7233 6.1
+// advises, headers with many ranges or ranges adding up to more than the
+// object are rejected like invalid ones, so that the whole object is sent.
+// ErrRangeNotSatisfiable is only returned when ranges were given but none
+// is left.
+func ParseRange(header string, size int) ([]ByteRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, fmt.Errorf("invalid range unit: %s", header)
+	}
+	var ranges []ByteRange
+	specs, total := 0, 0
+	for _, spec := range strings.Split(header[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		specs++
+		if specs > maxRanges {
+			return nil, fmt.Errorf("more than %d ranges", maxRanges)
+		}
+		index := strings.Index(spec, "-")
+		if index < 0 {
+			return nil, fmt.Errorf("invalid range: %s", spec)
+		}
+		first, last := spec[:index], spec[index+1:]
+		var r ByteRange
+		if first == "" {
+			// Suffix range, the last N bytes
+			n, err := strconv.Atoi(last)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid range: %s", spec)
+			}
+			if n > size {
+				n = size
+			}
+			if n == 0 {
+				continue
+			}
+			r = ByteRange{Start: size - n, End: size - 1}
+		} else {
+			start, err := strconv.Atoi(first)
+			if err != nil || start < 0 {
+				return nil, fmt.Errorf("invalid range: %s", spec)
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.Atoi(last)
+				if err != nil || end < start {
+					return nil, fmt.Errorf("invalid range: %s", spec)
+				}
+				if end > size-1 {
+					end = size - 1
+				}
+			}
+			if start >= size {
+				continue
+			}
+			r = ByteRange{Start: start, End: end}
+		}
+		ranges = append(ranges, r)
+		total += r.End - r.Start + 1
+	}
+	if specs == 0 {
+		return nil, fmt.Errorf("no range in %s", header)
+	}
+	if len(ranges) == 0 {
+		return nil, ErrRangeNotSatisfiable
+	}
+	if total > size {
+		return nil, fmt.Errorf("ranges of %d bytes exceed the object of %d", total, size)
+	}
+	return mergeRanges(ranges), nil
+}
+
+// mergeRanges sorts ranges and joins those which overlap or are adjacent
+func mergeRanges(ranges []ByteRange) []ByteRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Start < ranges[j].Start
+	})
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r.Start <= last.End+1 {
+			if r.End > last.End {
+				last.End = r.End
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// IfRangeMatch checks If-Range against a cached response, which may hold
+// either a strong entity tag or a Last-Modified date
+func IfRangeMatch(ifRange string, response *HTTPResponse) bool {
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, "W/") {
+		return false
+	}
+	if strings.HasPrefix(ifRange, "\"") {
+		return ifRange == response.Headers["ETag"]
+	}
+	lastModified, ok := response.Headers["Last-Modified"]
+	if !ok {
+		return false
+	}
+	t1, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	t2, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+	return t1.Equal(t2)
+}
+
+func RandomBoundary() string {
+	buffer := make([]byte, 16)
+	rand.Read(buffer)
+	return hex.EncodeToString(buffer)
+}
+
+// RangeResponse builds the response to a Range request from a full cached
+// response, the full response is returned untouched when there is no range
+// to apply
+func RangeResponse(response *HTTPResponse, rangeHeader string, ifRange string) *HTTPResponse {
+	if rangeHeader == "" || response.StatusCode != 200 {
+		return response
+	}
+	if !IfRangeMatch(ifRange, response) {
+		log.Debug("If-Range %s does not match, sending full object", ifRange)
+		return response
+	}
+	size := len(response.Body)
+	ranges, err := ParseRange(rangeHeader, size)
+	if err == ErrRangeNotSatisfiable {
+		return &HTTPResponse{
+			HTTPVersion:  response.HTTPVersion,
+			StatusCode:   416,
+			ReasonPhrase: "Requested Range Not Satisfiable",
+			Headers: map[string]string{
+				"Content-Range":  fmt.Sprintf("bytes */%d", size),
+				"Content-Length": "0",
+			},
+		}
+	}
+	if err != nil {
+		// Syntactically invalid ranges are ignored
+		log.Debug("Ignoring Range: %s", err)
+		return response
+	}
+
+	partial := &HTTPResponse{
+		HTTPVersion:  response.HTTPVersion,
+		StatusCode:   206,
+		ReasonPhrase: "Partial Content",
+		Headers:      make(map[string]string),
+	}
+	for k, v := range response.Headers {
+		partial.Headers[k] = v
+	}
+	if len(ranges) == 1 {
+		r := ranges[0]
+		partial.Headers["Content-Range"] = r.ContentRange(size)
+		partial.Body = response.Body[r.Start : r.End+1]
+	} else {
+		boundary := RandomBoundary()
+		contentType := response.Headers["Content-Type"]
+		buffer := new(bytes.Buffer)
+		for _, r := range ranges {
+			buffer.WriteString("--" + boundary + "\r\n")
+			if contentType != "" {
+				buffer.WriteString("Content-Type: " + contentType + "\r\n")
+			}
+			buffer.WriteString("Content-Range: " + r.ContentRange(size) + "\r\n")
+			buffer.WriteString("\r\n")
+			buffer.WriteString(response.Body[r.Start : r.End+1])
+			buffer.WriteString("\r\n")
+		}
+		buffer.WriteString("--" + boundary + "--\r\n")
+		partial.Headers["Content-Type"] = "multipart/byteranges; boundary=" + boundary
+		partial.Body = buffer.String()
+	}
+	partial.Headers["Content-Length"] = strconv.Itoa(len(partial.Body))
+	return partial
+}
@@ -0,0 +1,100 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		size   int
+		want   []ByteRange
+		err    bool
+	}{
+		{"bytes=0-99", 1000, []ByteRange{{0, 99}}, false},
+		{"bytes=500-", 1000, []ByteRange{{500, 999}}, false},
+		{"bytes=-100", 1000, []ByteRange{{900, 999}}, false},
+		{"bytes=-2000", 1000, []ByteRange{{0, 999}}, false},
+		{"bytes=900-1999", 1000, []ByteRange{{900, 999}}, false},
+		{"bytes=0-0, 10-19", 1000, []ByteRange{{0, 0}, {10, 19}}, false},
+		// Sorted, overlapping and adjacent ranges merged
+		{"bytes=500-599,0-99", 1000, []ByteRange{{0, 99}, {500, 599}}, false},
+		{"bytes=0-99,50-149,150-199", 1000, []ByteRange{{0, 199}}, false},
+		{"bytes=0-9,20-29,5-24", 1000, []ByteRange{{0, 29}}, false},
+		{"bytes=0-1,2-3,4-5,6-7,8-9,10-11,12-13,14-15,16-17,18-19,20-21,22-23,24-25,26-27,28-29,30-31", 1000, []ByteRange{{0, 31}}, false},
+		// Too many ranges, or more bytes than the object
+		{"bytes=0-1,2-3,4-5,6-7,8-9,10-11,12-13,14-15,16-17,18-19,20-21,22-23,24-25,26-27,28-29,30-31,32-33", 1000, nil, true},
+		{"bytes=0-,0-", 1000, nil, true},
+		{"bytes=0-599,400-", 1000, nil, true},
+		// Ranges past the end are dropped, none left is not satisfiable
+		{"bytes=0-9,2000-", 1000, []ByteRange{{0, 9}}, false},
+		{"bytes=1000-", 1000, nil, true},
+		{"bytes=-0", 1000, nil, true},
+		{"bytes=", 1000, nil, true},
+		{"items=0-9", 1000, nil, true},
+		{"bytes=9-0", 1000, nil, true},
+		{"bytes=a-9", 1000, nil, true},
+		{"bytes=5", 1000, nil, true},
+	}
+	for _, test := range tests {
+		got, err := ParseRange(test.header, test.size)
+		if (err != nil) != test.err {
+			t.Errorf("ParseRange(%q, %d) error = %v, want error %v", test.header, test.size, err, test.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseRange(%q, %d) = %v, want %v", test.header, test.size, got, test.want)
+		}
+	}
+}
+
+// Only ranges past the end are not satisfiable, other errors mean the header
+// is ignored
+func TestParseRangeNotSatisfiable(t *testing.T) {
+	tests := []struct {
+		header         string
+		notSatisfiable bool
+	}{
+		{"bytes=5000-", true},
+		{"bytes=1000-1999, 2000-", true},
+		{"bytes=-0", true},
+		{"bytes=", false},
+		{"bytes=,", false},
+		{"bytes= , ,", false},
+		{"bytes=0-,0-", false},
+		{"bytes=a-9", false},
+	}
+	for _, test := range tests {
+		_, err := ParseRange(test.header, 1000)
+		if err == nil || (err == ErrRangeNotSatisfiable) != test.notSatisfiable {
+			t.Errorf("ParseRange(%q) error = %v, want not satisfiable %v", test.header, err, test.notSatisfiable)
+		}
+	}
+}
+
+func TestRangeResponse(t *testing.T) {
+	response := &HTTPResponse{
+		HTTPVersion: "HTTP/1.0",
+		StatusCode:  200,
+		Headers:     map[string]string{"Content-Length": "10"},
+		Body:        "0123456789",
+	}
+	tests := []struct {
+		header string
+		status int
+		body   string
+	}{
+		{"bytes=2-4", 206, "234"},
+		{"bytes=2-4,3-6", 206, "23456"},
+		{"bytes=", 200, "0123456789"},
+		{"bytes=0-,0-,0-", 200, "0123456789"},
+		{"bytes=10-", 416, ""},
+	}
+	for _, test := range tests {
+		got := RangeResponse(response, test.header, "")
+		if got.StatusCode != test.status || got.Body != test.body {
+			t.Errorf("RangeResponse(%q) = %d %q, want %d %q", test.header, got.StatusCode, got.Body, test.status, test.body)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package model
+
+import (
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// RecentSize is how many finished requests are kept for the dashboard
+const RecentSize = 1000
+
+// RecentRecord is an access record numbered in the order requests finished
+type RecentRecord struct {
+	Seq uint64 `json:"seq"`
+	*AccessRecord
+}
+
+// RecentRequests keeps the last RecentSize records in a ring, and passes new
+// ones on to subscriptions
+type RecentRequests struct {
+	Lock    *sync.Mutex
+	Records []RecentRecord
+	// Seq of the newest record, 0 when there is none
+	Last          uint64
+	Subscriptions map[*Subscription]bool
+}
+
+var Recent = &RecentRequests{
+	Lock:          new(sync.Mutex),
+	Records:       make([]RecentRecord, RecentSize),
+	Subscriptions: make(map[*Subscription]bool),
+}
+
+// Subscription receives the records of requests as they finish
+type Subscription struct {
+	Filter  *RequestFilter
+	Records chan RecentRecord
+}
+
+// Records a subscription can fall behind by, later ones are dropped rather
+// than slowing requests down
+const subscriptionBuffer = 256
+
+func (o *RecentRequests) Add(record *AccessRecord) {
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	o.Last++
+	recent := RecentRecord{
+		Seq:          o.Last,
+		AccessRecord: record,
+	}
+	o.Records[o.Last%RecentSize] = recent
+	for subscription := range o.Subscriptions {
+		if !subscription.Filter.Match(record) {
+			continue
+		}
+		select {
+		case subscription.Records <- recent:
+		default:
+		}
+	}
+}
+
+// Subscribe starts passing the records matching filter to the returned
+// subscription. With backlog, the records still kept that are newer than
+// after and match are returned too, none is missed in between.
+func (o *RecentRequests) Subscribe(filter *RequestFilter, backlog bool, after uint64) (*Subscription, []RecentRecord) {
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	subscription := &Subscription{
+		Filter:  filter,
+		Records: make(chan RecentRecord, subscriptionBuffer),
+	}
+	o.Subscriptions[subscription] = true
+	records := []RecentRecord{}
+	if backlog {
+		for _, record := range o.after(after) {
+			if filter.Match(record.AccessRecord) {
+				records = append(records, record)
+			}
+		}
+	}
+	return subscription, records
+}
+
+func (o *RecentRequests) Unsubscribe(subscription *Subscription) {
+	o.Lock.Lock()
+	delete(o.Subscriptions, subscription)
+	o.Lock.Unlock()
+}
+
+// After returns the records still kept that are newer than seq, oldest
+// first, and the seq of the newest record
+func (o *RecentRequests) After(seq uint64) ([]RecentRecord, uint64) {
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	return o.after(seq), o.Last
+}
+
+// after is After without the lock, which must be held
+func (o *RecentRequests) after(seq uint64) []RecentRecord {
+	first := seq + 1
+	if o.Last >= RecentSize && first <= o.Last-RecentSize {
+		first = o.Last - RecentSize + 1
+	}
+	records := []RecentRecord{}
+	for s := first; s <= o.Last; s++ {
+		records = append(records, o.Records[s%RecentSize])
+	}
+	return records
+}
+
+// Host returns the hostname the record's request was for
+func (r *AccessRecord) Host() string {
+	if r.Method == "CONNECT" {
+		return GetHostname(r.URL)
+	}
+	requestURI, err := url.Parse(r.URL)
+	if err != nil {
+		return ""
+	}
+	return requestURI.Hostname()
+}
+
+type TopEntry struct {
+	Name     string `json:"name"`
+	Requests int    `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// Top ranks the recent records by key, most requests first, at most n
+// entries are returned
+func (o *RecentRequests) Top(n int, key func(*AccessRecord) string) []TopEntry {
+	records, _ := o.After(0)
+	entries := make(map[string]*TopEntry)
+	for _, record := range records {
+		name := key(record.AccessRecord)
+		if name == "" {
+			continue
+		}
+		entry, ok := entries[name]
+		if !ok {
+			entry = &TopEntry{Name: name}
+			entries[name] = entry
+		}
+		entry.Requests++
+		entry.Bytes += record.Bytes
+	}
+	top := make([]TopEntry, 0, len(entries))
+	for _, entry := range entries {
+		top = append(top, *entry)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Requests != top[j].Requests {
+			return top[i].Requests > top[j].Requests
+		}
+		return top[i].Name < top[j].Name
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
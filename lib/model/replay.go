@@ -0,0 +1,277 @@
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/WangYihang/PrGoxy/lib/config"
+	"github.com/WangYihang/PrGoxy/lib/util/log"
+)
+
+// ReplayEntry is an exchange of the archive, one json object per line
+type ReplayEntry struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	URL    string    `json:"url"`
+	// Hex sha256 of the request body
+	BodyHash string         `json:"body_hash"`
+	Response ReplayResponse `json:"response"`
+}
+
+type ReplayResponse struct {
+	HTTPVersion string            `json:"http_version"`
+	Status      int               `json:"status"`
+	Reason      string            `json:"reason"`
+	Headers     map[string]string `json:"headers"`
+	// Bodies that are valid UTF-8 are kept as text, others in base64
+	Body       string `json:"body,omitempty"`
+	BodyBase64 string `json:"body_base64,omitempty"`
+}
+
+func CreateReplayEntry(request *HTTPRequest, response *HTTPResponse) *ReplayEntry {
+	entry := &ReplayEntry{
+		Time:     time.Now(),
+		Method:   request.Method,
+		URL:      request.RequestURI.String(),
+		BodyHash: BodyHash(request.Body),
+		Response: ReplayResponse{
+			HTTPVersion: response.HTTPVersion,
+			Status:      response.StatusCode,
+			Reason:      response.ReasonPhrase,
+			Headers:     response.Headers,
+		},
+	}
+	if utf8.ValidString(response.Body) {
+		entry.Response.Body = response.Body
+	} else {
+		entry.Response.BodyBase64 = base64.StdEncoding.EncodeToString([]byte(response.Body))
+	}
+	return entry
+}
+
+func (entry *ReplayEntry) HTTPResponse() (*HTTPResponse, error) {
+	body := entry.Response.Body
+	if entry.Response.BodyBase64 != "" {
+		decoded, err := base64.StdEncoding.DecodeString(entry.Response.BodyBase64)
+		if err != nil {
+			return nil, err
+		}
+		body = string(decoded)
+	}
+	headers := entry.Response.Headers
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	return &HTTPResponse{
+		HTTPVersion:  entry.Response.HTTPVersion,
+		StatusCode:   entry.Response.Status,
+		ReasonPhrase: entry.Response.Reason,
+		Headers:      headers,
+		Body:         body,
+	}, nil
+}
+
+func BodyHash(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+func replayKey(replay *config.Replay, method string, uri string, bodyHash string) string {
+	key := method + " " + uri
+	if replay.MatchBody {
+		key += " " + bodyHash
+	}
+	return key
+}
+
+// Replayer appends to the archive when recording and answers from it when
+// replaying. The archive is opened again for each new config snapshot.
+type Replayer struct {
+	Lock *sync.Mutex
+	// Config snapshot the archive was opened for
+	Config *config.Config
+	// Archive being recorded to
+	File *os.File
+	// Responses of the archive being replayed by request, and how many
+	// times each request was answered
+	Responses map[string][]*HTTPResponse
+	Served    map[string]int
+}
+
+var Replays = &Replayer{
+	Lock: new(sync.Mutex),
+}
+
+// Record appends the exchange of a finished client to the archive in record
+// mode. Responses made by the proxy itself aren't recorded, nor those it
+// replayed.
+func (o *Replayer) Record(client *TCPClient) {
+	cfg := client.Config
+	if cfg.Replay.Mode != config.ReplayRecord || client.Original == nil {
+		return
+	}
+	request := client.Request
+	data, err := json.Marshal(CreateReplayEntry(request, client.Original))
+	if err != nil {
+		log.Error("Failed to record %s: %s", request.RequestURI, err)
+		return
+	}
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	if !o.use(cfg) || o.File == nil {
+		return
+	}
+	_, err = o.File.Write(append(data, '\n'))
+	if err != nil {
+		log.Error("Failed to write replay archive: %s", err)
+	}
+}
+
+// Lookup returns the recorded response of the client's request in replay
+// mode. When a request was recorded several times its responses are served
+// in turn, the last one again and again.
+func (o *Replayer) Lookup(client *TCPClient) (*HTTPResponse, bool) {
+	cfg := client.Config
+	if !cfg.Replay.Replaying() {
+		return nil, false
+	}
+	request := client.Request
+	key := replayKey(&cfg.Replay, request.Method, request.RequestURI.String(), BodyHash(request.Body))
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	if !o.use(cfg) {
+		return nil, false
+	}
+	responses := o.Responses[key]
+	if len(responses) == 0 {
+		return nil, false
+	}
+	i := o.Served[key]
+	if i >= len(responses) {
+		i = len(responses) - 1
+	}
+	o.Served[key]++
+	return responses[i], true
+}
+
+// use opens the archive of a client's config snapshot, the lock must be
+// held. Clients still on an older snapshot than the open one don't switch
+// back to it, they share the open archive if their replay settings are the
+// same and go without otherwise.
+func (o *Replayer) use(cfg *config.Config) bool {
+	if o.Config == cfg {
+		return true
+	}
+	if o.Config != nil && o.Config == config.Get() {
+		return o.Config.Replay == cfg.Replay
+	}
+	o.open(cfg)
+	return true
+}
+
+// open switches to the archive of cfg, the lock must be held
+func (o *Replayer) open(cfg *config.Config) {
+	if o.File != nil {
+		o.File.Close()
+	}
+	o.File = nil
+	o.Responses = make(map[string][]*HTTPResponse)
+	o.Served = make(map[string]int)
+	o.Config = cfg
+	switch cfg.Replay.Mode {
+	case config.ReplayRecord:
+		file, err := os.OpenFile(cfg.Replay.Archive, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Error("Failed to open replay archive: %s", err)
+			return
+		}
+		o.File = file
+	case config.ReplayReplay:
+		o.load(cfg)
+	}
+}
+
+// load reads the archive of cfg, malformed lines are skipped
+func (o *Replayer) load(cfg *config.Config) {
+	file, err := os.Open(cfg.Replay.Archive)
+	if err != nil {
+		log.Error("Failed to open replay archive: %s", err)
+		return
+	}
+	defer file.Close()
+	// Lines hold whole bodies, they can be longer than a scanner allows
+	reader := bufio.NewReader(file)
+	entries := 0
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(data)) > 0 {
+			entry, response, parseErr := parseReplayLine(data)
+			if parseErr != nil {
+				log.Error("Replay archive %s line %d: %s", cfg.Replay.Archive, line, parseErr)
+			} else {
+				key := replayKey(&cfg.Replay, entry.Method, entry.URL, entry.BodyHash)
+				o.Responses[key] = append(o.Responses[key], response)
+				entries++
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Error("Failed to read replay archive: %s", err)
+			break
+		}
+	}
+	log.Info("Replaying %d exchanges from %s", entries, cfg.Replay.Archive)
+}
+
+func parseReplayLine(data []byte) (*ReplayEntry, *HTTPResponse, error) {
+	entry := &ReplayEntry{}
+	err := json.Unmarshal(data, entry)
+	if err != nil {
+		return nil, nil, err
+	}
+	response, err := entry.HTTPResponse()
+	if err != nil {
+		return nil, nil, err
+	}
+	return entry, response, nil
+}
+
+// ReplayHandler answers the request from the archive in replay mode, false
+// means the request goes on to the network. CONNECT tunnels can't be replayed
+// and count as unmatched.
+func (o *TCPClient) ReplayHandler() bool {
+	replay := &o.Config.Replay
+	if !replay.Replaying() {
+		return false
+	}
+	if o.Request.Method != "CONNECT" {
+		if response, ok := Replays.Lookup(o); ok {
+			o.Decision = DecisionReplayed
+			n := o.Respond(response)
+			log.Info("%s %s %s [REPLAY][%d][%d]", o.Request.Method, o.ToString(), o.Request.RequestURI, response.StatusCode, n)
+			return true
+		}
+	}
+	if replay.Passes() {
+		return false
+	}
+	target := o.Request.RequestURI.String()
+	if o.Request.Method == "CONNECT" {
+		target = o.Request.RequestURI.Host
+	}
+	log.Warn("%s %s %s is not in the replay archive", o.Request.Method, o.ToString(), target)
+	o.Decision = DecisionNotInArchive
+	o.Respond(CreateErrorResponse(502, "Not In Replay Archive"))
+	return true
+}
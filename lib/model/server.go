@@ -2,76 +2,245 @@ package model
 
 import (
 	"container/list"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/WangYihang/PrGoxy/lib/config"
+	"github.com/WangYihang/PrGoxy/lib/upgrade"
 	"github.com/WangYihang/PrGoxy/lib/util/log"
 )
 
 type TCPServer struct {
-	Host    string
-	Port    int16
-	Clients *list.List
+	Host     string
+	Port     int
+	Listener config.Listener
+	Clients  *list.List
+	// Elements of Clients by connection id
+	Index map[uint64]*list.Element
+	// Guards Socket, Acceptor, Clients and Index
+	Lock *sync.Mutex
+	// Listening socket, and the listener clients are accepted from, which
+	// wraps it in TLS if configured
+	Socket   net.Listener
+	Acceptor net.Listener
+	// Set once Shutdown is called
+	Closing int32
 }
 
-func CreateTCPServer(host string, port int16) *TCPServer {
+func CreateTCPServer(listener config.Listener) *TCPServer {
+	if listener.Protocol == "" {
+		listener.Protocol = config.ProtocolHTTP
+	}
 	return &TCPServer{
-		Host:    host,
-		Port:    port,
-		Clients: list.New(),
+		Host:     listener.LHost,
+		Port:     listener.LPort,
+		Listener: listener,
+		Clients:  list.New(),
+		Index:    make(map[uint64]*list.Element),
+		Lock:     new(sync.Mutex),
 	}
 }
 
 func (o *TCPServer) ToString() string {
-	if config.Cfg.Cache {
-		return fmt.Sprintf("%s:%d (Cache enabled)", o.Host, o.Port)
+	description := o.Listener.Protocol
+	if o.Listener.Protocol == config.ProtocolReverse {
+		description += " to " + o.Listener.Upstream
+	}
+	if o.Listener.TLS != nil {
+		description += ", TLS"
+	}
+	if config.Get().PolicyOf(o.Listener.Name).Cache {
+		description += ", Cache enabled"
 	} else {
-		return fmt.Sprintf("%s:%d (Cache disabled)", o.Host, o.Port)
+		description += ", Cache disabled"
 	}
+	return fmt.Sprintf("%s %s (%s)", o.Listener.Name, o.Listener.Address(), description)
 }
 
-func (o *TCPServer) Run() {
-	service := fmt.Sprintf("%s:%d", o.Host, o.Port)
-	tcpAddr, err := net.ResolveTCPAddr("tcp4", service)
+// Listen binds the listening socket, or takes it over from the process
+// being upgraded
+func (o *TCPServer) Listen() error {
+	socket, err := upgrade.Listen(o.Listener.Name, o.Listener.Address())
 	if err != nil {
-		log.Error("Resolve TCP address failed: %s", err)
-		return
+		return err
 	}
-	listener, err := net.ListenTCP("tcp", tcpAddr)
-	if err != nil {
-		log.Error("Listen failed: %s", err)
+	acceptor := socket
+	if o.Listener.TLS != nil {
+		store, err := CreateTLSStore(*o.Listener.TLS)
+		if err != nil {
+			socket.Close()
+			return err
+		}
+		acceptor = tls.NewListener(socket, &tls.Config{
+			GetConfigForClient: store.GetConfigForClient,
+		})
+	}
+	o.Lock.Lock()
+	o.Socket = socket
+	o.Acceptor = acceptor
+	o.Lock.Unlock()
+	return nil
+}
+
+// Run accepts clients until Shutdown, Listen must have been called
+func (o *TCPServer) Run() {
+	o.Lock.Lock()
+	listener := o.Acceptor
+	o.Lock.Unlock()
+	if o.IsClosing() {
 		return
 	}
-	log.Info(fmt.Sprintf("Server running at: %s", o.ToString()))
+	log.Info("Server running at: %s", o.ToString())
+	var delay time.Duration
 	for {
+		// Leave connections over the limit in the listen backlog instead of
+		// accepting them to wait
+		limits := &config.Get().Limits
+		if limits.Wait() {
+			Admissions.WaitBelow(limits.MaxConnections, o.IsClosing)
+		}
 		conn, err := listener.Accept()
 		if err != nil {
+			if o.IsClosing() {
+				log.Info("Server stopped accepting: %s", o.Listener.Name)
+				return
+			}
+			// Out of file descriptors and the like, back off instead of
+			// spinning on the error
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay < time.Second {
+				delay *= 2
+			}
+			log.Error("Accept failed: %s, retrying in %s", err, delay)
+			time.Sleep(delay)
 			continue
 		}
+		delay = 0
 		client := CreateTCPClient(conn, o)
 		log.Debug("New client %s Connected", client.ToString())
 		o.AddTCPClient(client)
-		go client.PrGoxy()
+		go func() {
+			err := client.Admit()
+			if !client.TLSHandshake() {
+				return
+			}
+			if err != nil {
+				client.Reject()
+				return
+			}
+			if o.Listener.Protocol == config.ProtocolSOCKS {
+				client.SOCKS()
+			} else {
+				client.PrGoxy()
+			}
+		}()
 	}
 }
 
-func Contains(l *list.List, value *TCPClient) *list.Element {
-	for e := l.Front(); e != nil; e = e.Next() {
-		if e.Value == value {
-			return e
+func (o *TCPServer) IsClosing() bool {
+	return atomic.LoadInt32(&o.Closing) == 1
+}
+
+// Shutdown stops accepting connections and waits for connected clients to
+// finish, open tunnels and background cache refreshes included. Clients still
+// connected when ctx is done are closed.
+func (o *TCPServer) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&o.Closing, 1)
+	o.Lock.Lock()
+	if o.Socket != nil {
+		o.Socket.Close()
+	}
+	o.Lock.Unlock()
+	// Connections waiting for a slot give up
+	Admissions.Wake()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		n := o.ClientCount()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			log.Warn("%d client(s) of %s still connected, closing", n, o.Listener.Name)
+			for _, client := range o.ClientList() {
+				client.Conn.Close()
+			}
+			return ctx.Err()
+		case <-ticker.C:
 		}
 	}
-	return nil
 }
 
 func (o *TCPServer) DeleteTCPClient(client *TCPClient) {
 	defer client.Close()
-	if e := Contains(o.Clients, client); e != nil {
+	o.Lock.Lock()
+	e, ok := o.Index[client.ID]
+	if ok {
 		o.Clients.Remove(e)
+		delete(o.Index, client.ID)
+	}
+	o.Lock.Unlock()
+	// Only the first delete finds the client
+	if !ok {
+		return
+	}
+	if client.Release != nil {
+		client.Release()
+	}
+	if !client.Upstream {
+		ActiveConnections.Add(-1, o.Listener.Name)
+	}
+	if client.Requested() {
+		record := CreateAccessRecord(client)
+		AccessLog.Log(record)
+		Recent.Add(record)
+		Captures.Record(client, record)
+		Spans.Record(client, record)
+		Replays.Record(client)
+		CountRequest(client)
 	}
 }
 
 func (o *TCPServer) AddTCPClient(client *TCPClient) {
-	o.Clients.PushBack(client)
+	o.Lock.Lock()
+	o.Index[client.ID] = o.Clients.PushBack(client)
+	o.Lock.Unlock()
+	if !client.Upstream {
+		ActiveConnections.Add(1, o.Listener.Name)
+	}
+}
+
+func (o *TCPServer) ClientCount() int {
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	return o.Clients.Len()
+}
+
+// ClientList returns a copy of the connected clients
+func (o *TCPServer) ClientList() []*TCPClient {
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	clients := make([]*TCPClient, 0, o.Clients.Len())
+	for e := o.Clients.Front(); e != nil; e = e.Next() {
+		clients = append(clients, e.Value.(*TCPClient))
+	}
+	return clients
+}
+
+// Find returns the connected client with the given id, or nil
+func (o *TCPServer) Find(id uint64) *TCPClient {
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	if e, ok := o.Index[id]; ok {
+		return e.Value.(*TCPClient)
+	}
+	return nil
 }
@@ -0,0 +1,241 @@
+package model
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+
+	"github.com/WangYihang/PrGoxy/lib/util/log"
+)
+
+// SOCKS5 (RFC 1928) with username/password authentication (RFC 1929)
+const (
+	socksVersion = 0x05
+
+	socksMethodNoAuth       = 0x00
+	socksMethodUserPass     = 0x02
+	socksMethodNoAcceptable = 0xff
+
+	socksCommandConnect = 0x01
+
+	socksAddressIPv4   = 0x01
+	socksAddressDomain = 0x03
+	socksAddressIPv6   = 0x04
+
+	socksReplySucceeded           = 0x00
+	socksReplyNotAllowed          = 0x02
+	socksReplyHostUnreachable     = 0x04
+	socksReplyTTLExpired          = 0x06
+	socksReplyCommandNotSupported = 0x07
+	socksReplyAddressNotSupported = 0x08
+)
+
+func (o *TCPClient) ReadFull(size int) ([]byte, bool) {
+	buffer := make([]byte, size)
+	o.ReadLock.Lock()
+	n, err := io.ReadFull(o.Conn, buffer)
+	o.ReadLock.Unlock()
+	o.CountReceived(n)
+	if err != nil {
+		if IsTimeout(err) {
+			log.Warn("Client (%s) timed out during SOCKS negotiation", o.ToString())
+		} else {
+			log.Error("Read from client failed")
+		}
+		o.Server.DeleteTCPClient(o)
+		return nil, false
+	}
+	return buffer, true
+}
+
+// SOCKSReply answers a SOCKS request, the bound address is always reported
+// as 0.0.0.0:0 which clients ignore for CONNECT
+func (o *TCPClient) SOCKSReply(reply byte) {
+	o.Write([]byte{socksVersion, reply, 0x00, socksAddressIPv4, 0, 0, 0, 0, 0, 0})
+}
+
+func (o *TCPClient) SOCKSAuthenticate() bool {
+	header, ok := o.ReadFull(2)
+	if !ok {
+		return false
+	}
+	if header[0] != socksVersion {
+		log.Warn("Client (%s) sent unsupported SOCKS version %d", o.ToString(), header[0])
+		o.Server.DeleteTCPClient(o)
+		return false
+	}
+	methods, ok := o.ReadFull(int(header[1]))
+	if !ok {
+		return false
+	}
+	want := byte(socksMethodNoAuth)
+	if len(o.Policy.Auth) > 0 && o.User == "" {
+		want = socksMethodUserPass
+	}
+	supported := false
+	for _, method := range methods {
+		if method == want {
+			supported = true
+		}
+	}
+	if !supported {
+		o.ResponseAndAbort(string([]byte{socksVersion, socksMethodNoAcceptable}))
+		return false
+	}
+	o.Write([]byte{socksVersion, want})
+	if want == socksMethodNoAuth {
+		return true
+	}
+
+	// +----+------+----------+------+----------+
+	// |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+	// +----+------+----------+------+----------+
+	header, ok = o.ReadFull(2)
+	if !ok {
+		return false
+	}
+	user, ok := o.ReadFull(int(header[1]))
+	if !ok {
+		return false
+	}
+	length, ok := o.ReadFull(1)
+	if !ok {
+		return false
+	}
+	password, ok := o.ReadFull(int(length[0]))
+	if !ok {
+		return false
+	}
+	if !o.Policy.Authenticate(string(user), string(password)) {
+		log.Warn("Client (%s) failed to authenticate as %s", o.ToString(), user)
+		o.Decision = DecisionUnauthorized
+		o.ResponseAndAbort(string([]byte{0x01, 0x01}))
+		return false
+	}
+	o.User = string(user)
+	o.Write([]byte{0x01, 0x00})
+	return true
+}
+
+// SOCKSRequest reads the CONNECT request into o.Request, the same way the
+// CONNECT method of HTTP is represented
+func (o *TCPClient) SOCKSRequest() bool {
+	// +----+-----+-------+------+----------+----------+
+	// |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
+	// +----+-----+-------+------+----------+----------+
+	header, ok := o.ReadFull(4)
+	if !ok {
+		return false
+	}
+	if header[1] != socksCommandConnect {
+		o.SOCKSReply(socksReplyCommandNotSupported)
+		o.Server.DeleteTCPClient(o)
+		return false
+	}
+	var host string
+	switch header[3] {
+	case socksAddressIPv4:
+		address, ok := o.ReadFull(net.IPv4len)
+		if !ok {
+			return false
+		}
+		host = net.IP(address).String()
+	case socksAddressIPv6:
+		address, ok := o.ReadFull(net.IPv6len)
+		if !ok {
+			return false
+		}
+		host = net.IP(address).String()
+	case socksAddressDomain:
+		length, ok := o.ReadFull(1)
+		if !ok {
+			return false
+		}
+		address, ok := o.ReadFull(int(length[0]))
+		if !ok {
+			return false
+		}
+		host = string(address)
+	default:
+		o.SOCKSReply(socksReplyAddressNotSupported)
+		o.Server.DeleteTCPClient(o)
+		return false
+	}
+	port, ok := o.ReadFull(2)
+	if !ok {
+		return false
+	}
+	o.Request.Method = "CONNECT"
+	o.Request.RequestURI = &url.URL{
+		Host: net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))),
+	}
+	o.Request.HTTPVersion = "SOCKS5"
+	return true
+}
+
+// SOCKS serves a client of a SOCKS listener, only CONNECT is supported
+func (o *TCPClient) SOCKS() {
+	// Client guard
+	if o.ClientFilterHandler() {
+		return
+	}
+	timeouts := &o.Config.Timeouts
+	o.SetReadTimeout(timeouts.HeaderTimeout())
+	o.SetState(StateReading)
+	if !o.SOCKSAuthenticate() {
+		return
+	}
+	if !o.SOCKSRequest() {
+		return
+	}
+	// Tunnels carry no headers, the id and trace are only for logs and spans
+	o.RequestID = CreateRequestID()
+	o.PropagateTrace()
+	// Website guard
+	if v, ok := o.SiteBlocked(); ok {
+		log.Warn("Website (%s) is blocked", v)
+		BlockedTotal.Inc("site", v)
+		o.Decision = DecisionBlockedSite
+		o.SOCKSReply(socksReplyNotAllowed)
+		o.Server.DeleteTCPClient(o)
+		return
+	}
+	// Redirect handler
+	o.RedirectHandler()
+	o.SetState(StateProxying)
+	// Tunnels can't be replayed, replay mode keeps off the network unless
+	// unmatched requests may pass
+	if replay := &o.Config.Replay; replay.Replaying() && !replay.Passes() {
+		log.Warn("SOCKS CONNECT %s refused in replay mode", o.Request.RequestURI.Host)
+		o.Decision = DecisionNotInArchive
+		o.SOCKSReply(socksReplyNotAllowed)
+		o.Server.DeleteTCPClient(o)
+		return
+	}
+	host := GetHostname(o.Request.RequestURI.Host)
+	port := GetPort(o.Request.RequestURI.Host, 443)
+	client, err := ProxyConnectToServer(o, host, port)
+	if err != nil {
+		log.Error("Server (%s) is unavailable: %s", o.Request.RequestURI.Host, err)
+		if err == ErrLimitReached {
+			o.SOCKSReply(socksReplyNotAllowed)
+		} else if IsTimeout(err) {
+			o.SOCKSReply(socksReplyTTLExpired)
+		} else {
+			o.SOCKSReply(socksReplyHostUnreachable)
+		}
+		o.Server.DeleteTCPClient(o)
+		return
+	}
+	log.Info("SOCKS CONNECT %s %s", o.ToString(), o.Request.RequestURI.Host)
+	o.Timings.DNS = client.Timings.DNS
+	o.Timings.Connect = client.Timings.Connect
+	o.SetState(StateTunnel)
+	o.SOCKSReply(socksReplySucceeded)
+	// Transfer data
+	tunnel := CreateTunnel(timeouts.TunnelTimeout())
+	go Pipe(client, o, "Server -> Client", tunnel)
+	go Pipe(o, client, "Client -> Server", tunnel)
+}
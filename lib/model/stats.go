@@ -0,0 +1,44 @@
+package model
+
+import (
+	"time"
+)
+
+// Stats is a snapshot of the counters shown on the dashboard, totals are
+// since start, rates are left to whoever compares two snapshots
+type Stats struct {
+	Time        time.Time `json:"time"`
+	Requests    int64     `json:"requests"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	CacheHits   int64     `json:"cache_hits"`
+	CacheMisses int64     `json:"cache_misses"`
+	Blocked     int64     `json:"blocked"`
+	Connections int64     `json:"connections"`
+	Tunnels     int64     `json:"tunnels"`
+	// Over the recent requests
+	TopClients []TopEntry `json:"top_clients"`
+	TopHosts   []TopEntry `json:"top_hosts"`
+}
+
+func CurrentStats(top int) Stats {
+	// Revalidated and stale responses were served from cache
+	hits := RequestsTotal.Sum("cache", CacheStatusHit) +
+		RequestsTotal.Sum("cache", CacheStatusRevalidated) +
+		RequestsTotal.Sum("cache", CacheStatusStale)
+	return Stats{
+		Time:        time.Now(),
+		Requests:    int64(RequestsTotal.Sum()),
+		BytesIn:     int64(BytesTotal.Sum("direction", "in", "peer", "client")),
+		BytesOut:    int64(BytesTotal.Sum("direction", "out", "peer", "client")),
+		CacheHits:   int64(hits),
+		CacheMisses: int64(RequestsTotal.Sum("cache", CacheStatusMiss)),
+		Blocked:     int64(BlockedTotal.Sum()),
+		Connections: int64(ActiveConnections.Sum()),
+		Tunnels:     int64(ActiveTunnels.Sum()),
+		TopClients: Recent.Top(top, func(r *AccessRecord) string {
+			return r.Client
+		}),
+		TopHosts: Recent.Top(top, (*AccessRecord).Host),
+	}
+}
@@ -0,0 +1,116 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Phases of a request as named in metrics, the access log and Server-Timing,
+// client-tls is the handshake with the client
+const (
+	PhaseClientTLS = "client-tls"
+	PhaseDNS       = "dns"
+	PhaseConnect   = "connect"
+	PhaseSend      = "send"
+	PhaseTTFB      = "ttfb"
+	PhaseTransfer  = "transfer"
+)
+
+// Timings of a request, each step is zero when it didn't happen
+type Timings struct {
+	// Resolving the upstream host
+	DNS time.Duration
+	// Connecting to the upstream server once resolved
+	Connect time.Duration
+	// TLS handshake with the client, on TLS listeners. Upstream servers are
+	// spoken to in plain HTTP.
+	TLS time.Duration
+	// Sending the request
+	Send time.Duration
+	// Waiting for the first byte of the response
+	Wait time.Duration
+	// Reading the rest of the response
+	Receive time.Duration
+}
+
+// Upstream tells whether the request went to an upstream server
+func (t *Timings) Upstream() bool {
+	return t.DNS+t.Connect+t.Send+t.Wait+t.Receive > 0
+}
+
+// Phases lists the steps that happened, in order
+func (t *Timings) Phases() []Phase {
+	all := []Phase{
+		{PhaseClientTLS, t.TLS},
+		{PhaseDNS, t.DNS},
+		{PhaseConnect, t.Connect},
+		{PhaseSend, t.Send},
+		{PhaseTTFB, t.Wait},
+		{PhaseTransfer, t.Receive},
+	}
+	phases := all[:0]
+	for _, phase := range all {
+		if phase.Duration > 0 {
+			phases = append(phases, phase)
+		}
+	}
+	return phases
+}
+
+type Phase struct {
+	Name     string
+	Duration time.Duration
+}
+
+// ServerTiming formats the phases as a Server-Timing header, durations in
+// milliseconds, with the time spent in the proxy so far as total
+func (t *Timings) ServerTiming(total time.Duration) string {
+	var metrics []string
+	for _, phase := range t.Phases() {
+		metrics = append(metrics, fmt.Sprintf("%s;dur=%.3f", phase.Name, milliseconds(phase.Duration)))
+	}
+	metrics = append(metrics, fmt.Sprintf("total;dur=%.3f", milliseconds(total)))
+	return strings.Join(metrics, ", ")
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// DialUpstream connects to an upstream server within the timeout. The
+// dialer races IPv6 and IPv4 addresses and gives each address it tries a
+// share of the time left. Resolving is timed apart through the trace hooks
+// of the dial.
+func DialUpstream(host string, port int, timeout time.Duration) (net.Conn, Timings, error) {
+	var timings Timings
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// Hosts given as addresses are not resolved
+	connecting := time.Now()
+	resolved := true
+	var resolving time.Time
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			resolving = time.Now()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			connecting = time.Now()
+			timings.DNS = connecting.Sub(resolving)
+			resolved = info.Err == nil
+		},
+	})
+	dialer := &net.Dialer{FallbackDelay: 300 * time.Millisecond}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if resolved {
+		timings.Connect = time.Since(connecting)
+	}
+	if err != nil {
+		return nil, timings, err
+	}
+	return conn, timings, nil
+}
@@ -0,0 +1,144 @@
+package model
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/WangYihang/PrGoxy/lib/config"
+	"github.com/WangYihang/PrGoxy/lib/util/log"
+)
+
+// TLSStore holds the TLS config of a listener, certificate files are checked
+// for changes at most once a second and reloaded without a restart
+type TLSStore struct {
+	Settings config.TLS
+	Lock     *sync.Mutex
+	Config   *tls.Config
+	Modified time.Time
+	Checked  time.Time
+}
+
+func CreateTLSStore(settings config.TLS) (*TLSStore, error) {
+	store := &TLSStore{
+		Settings: settings,
+		Lock:     new(sync.Mutex),
+	}
+	modified, err := store.LastModified()
+	if err != nil {
+		return nil, err
+	}
+	err = store.Load(modified)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (o *TLSStore) Files() []string {
+	files := []string{o.Settings.Cert, o.Settings.Key}
+	if o.Settings.ClientCA != "" {
+		files = append(files, o.Settings.ClientCA)
+	}
+	return files
+}
+
+func (o *TLSStore) LastModified() (time.Time, error) {
+	var modified time.Time
+	for _, file := range o.Files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return modified, err
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return modified, nil
+}
+
+func (o *TLSStore) Load(modified time.Time) error {
+	certificate, err := tls.LoadX509KeyPair(o.Settings.Cert, o.Settings.Key)
+	if err != nil {
+		return err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+	}
+	if o.Settings.ClientCA != "" {
+		data, err := os.ReadFile(o.Settings.ClientCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("No certificate found in %s", o.Settings.ClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		if o.Settings.ClientAuth == "optional" {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	o.Config = tlsConfig
+	o.Modified = modified
+	return nil
+}
+
+// GetConfigForClient is called on every handshake, it reloads the
+// certificates if their files changed and keeps the old ones on failure
+func (o *TLSStore) GetConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	o.Lock.Lock()
+	defer o.Lock.Unlock()
+	if time.Since(o.Checked) < time.Second {
+		return o.Config, nil
+	}
+	o.Checked = time.Now()
+	modified, err := o.LastModified()
+	if err != nil || !modified.After(o.Modified) {
+		return o.Config, nil
+	}
+	err = o.Load(modified)
+	if err != nil {
+		log.Warn("Failed to reload certificate %s, keeping the previous one: %s", o.Settings.Cert, err)
+		return o.Config, nil
+	}
+	log.Info("Certificate %s reloaded", o.Settings.Cert)
+	return o.Config, nil
+}
+
+// TLSHandshake completes the handshake of a TLS client, a verified client
+// certificate authenticates the client as its common name. When the policy
+// has users the name must be one of them, other clients still have to give
+// a password.
+func (o *TCPClient) TLSHandshake() bool {
+	conn, ok := o.Conn.(*tls.Conn)
+	if !ok {
+		return true
+	}
+	// A handshake is held to the same limit as request headers
+	conn.SetDeadline(time.Now().Add(o.Config.Timeouts.HeaderTimeout()))
+	started := time.Now()
+	err := conn.Handshake()
+	o.Timings.TLS = time.Since(started)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		log.Warn("TLS handshake with %s failed: %s", o.ToString(), err)
+		o.Server.DeleteTCPClient(o)
+		return false
+	}
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) > 0 {
+		name := state.PeerCertificates[0].Subject.CommonName
+		if !o.Policy.HasUser(name) {
+			log.Warn("Client %s has a certificate of %s, who is not a user of the policy", o.ToString(), name)
+			return true
+		}
+		o.User = name
+		log.Debug("Client %s authenticated by certificate as %s", o.ToString(), o.User)
+	}
+	return true
+}
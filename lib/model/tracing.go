@@ -0,0 +1,297 @@
+package model
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/WangYihang/PrGoxy/lib/config"
+	"github.com/WangYihang/PrGoxy/lib/otlp"
+	"github.com/WangYihang/PrGoxy/lib/util/log"
+)
+
+// Headers carrying the request id and the W3C trace context, see
+// https://www.w3.org/TR/trace-context/
+const (
+	RequestIDHeader   = "X-Request-ID"
+	TraceparentHeader = "traceparent"
+	// Phases of the request, see Timings
+	ServerTimingHeader = "Server-Timing"
+)
+
+// Spans are exported in batches of that many, or every interval
+const (
+	SpanBatchSize      = 512
+	SpanExportInterval = 5 * time.Second
+	// Spans waiting for export beyond that are dropped
+	MaxPendingSpans = 8192
+)
+
+// TraceContext is the place of a request in a distributed trace. The proxy
+// adds a span to the trace of the client, or starts one.
+type TraceContext struct {
+	TraceID string
+	// Span of the client, empty if the trace started here
+	ParentID string
+	// Span of the proxy, the parent of the upstream server's
+	SpanID  string
+	Sampled bool
+}
+
+// Traceparent formats the context as sent upstream
+func (trace *TraceContext) Traceparent() string {
+	flags := "00"
+	if trace.Sampled {
+		flags = "01"
+	}
+	return "00-" + trace.TraceID + "-" + trace.SpanID + "-" + flags
+}
+
+func randomHex(size int) string {
+	buffer := make([]byte, size)
+	rand.Read(buffer)
+	return hex.EncodeToString(buffer)
+}
+
+func CreateRequestID() string {
+	return randomHex(16)
+}
+
+func isHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// isID tells lowercase hex ids of the given length that aren't all zero
+func isID(s string, length int) bool {
+	return isHex(s, length) && strings.Trim(s, "0") != ""
+}
+
+// ParseTraceparent reads the trace context of the client, a new trace is
+// started when the header is missing or invalid
+func ParseTraceparent(value string) (TraceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || !isHex(parts[0], 2) || parts[0] == "ff" {
+		return TraceContext{}, false
+	}
+	// Later versions may append fields, version 00 has exactly four
+	if parts[0] == "00" && len(parts) != 4 {
+		return TraceContext{}, false
+	}
+	if !isID(parts[1], 32) || !isID(parts[2], 16) || !isHex(parts[3], 2) {
+		return TraceContext{}, false
+	}
+	flags, _ := hex.DecodeString(parts[3])
+	return TraceContext{
+		TraceID:  parts[1],
+		ParentID: parts[2],
+		Sampled:  flags[0]&1 == 1,
+	}, true
+}
+
+// HeaderValue looks a header up whatever its case
+func HeaderValue(headers map[string]string, name string) (string, bool) {
+	if v, ok := headers[name]; ok {
+		return v, true
+	}
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// SetHeader replaces a header whatever the case it was sent in
+func SetHeader(headers map[string]string, name string, value string) {
+	for k := range headers {
+		if strings.EqualFold(k, name) {
+			delete(headers, k)
+		}
+	}
+	headers[name] = value
+}
+
+// PropagateTrace joins the trace of the client, or starts one, and passes the
+// request id and the span of the proxy on to the upstream server
+func (o *TCPClient) PropagateTrace() {
+	value, _ := HeaderValue(o.Request.Headers, TraceparentHeader)
+	trace, ok := ParseTraceparent(value)
+	if !ok {
+		trace = TraceContext{
+			TraceID: randomHex(16),
+			Sampled: true,
+		}
+	}
+	trace.SpanID = randomHex(8)
+	o.Trace = trace
+	SetHeader(o.Request.Headers, RequestIDHeader, o.RequestID)
+	SetHeader(o.Request.Headers, TraceparentHeader, trace.Traceparent())
+}
+
+// ClientResponse returns the response as sent to the client, with the
+// request id and Server-Timing if enabled. Responses may be shared with
+// cache, they are copied.
+func (o *TCPClient) ClientResponse(response *HTTPResponse) *HTTPResponse {
+	if o.RequestID == "" && !o.Config.ServerTiming {
+		return response
+	}
+	sent := *response
+	sent.Headers = make(map[string]string, len(response.Headers)+2)
+	for k, v := range response.Headers {
+		sent.Headers[k] = v
+	}
+	if o.RequestID != "" {
+		SetHeader(sent.Headers, RequestIDHeader, o.RequestID)
+	}
+	if o.Config.ServerTiming {
+		SetHeader(sent.Headers, ServerTimingHeader, o.Timings.ServerTiming(time.Since(o.Started)))
+	}
+	return &sent
+}
+
+// SpanExporter batches the spans of finished requests for the collector
+type SpanExporter struct {
+	Lock    *sync.Mutex
+	Pending []otlp.Span
+	// Wakes the export loop up once a batch is full
+	Full    chan struct{}
+	started *sync.Once
+}
+
+var Spans = &SpanExporter{
+	Lock:    new(sync.Mutex),
+	Full:    make(chan struct{}, 1),
+	started: new(sync.Once),
+}
+
+// Record queues the span of a finished client, if the request was traced
+// and spans are exported
+func (o *SpanExporter) Record(client *TCPClient, record *AccessRecord) {
+	if client.Trace.TraceID == "" || !client.Trace.Sampled || !client.Config.Tracing.Exporting() {
+		return
+	}
+	o.started.Do(func() {
+		go o.Run()
+	})
+	span := CreateSpan(client, record)
+	o.Lock.Lock()
+	if len(o.Pending) >= MaxPendingSpans {
+		o.Lock.Unlock()
+		SpansTotal.Inc("dropped")
+		return
+	}
+	o.Pending = append(o.Pending, span)
+	full := len(o.Pending) >= SpanBatchSize
+	o.Lock.Unlock()
+	if full {
+		select {
+		case o.Full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run exports the pending spans every interval or once a batch is full
+func (o *SpanExporter) Run() {
+	ticker := time.NewTicker(SpanExportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-o.Full:
+		}
+		o.Flush()
+	}
+}
+
+// Flush exports the pending spans at once, in batches, to the collector of
+// the current config
+func (o *SpanExporter) Flush() {
+	for {
+		o.Lock.Lock()
+		n := len(o.Pending)
+		if n > SpanBatchSize {
+			n = SpanBatchSize
+		}
+		batch := o.Pending[:n:n]
+		o.Pending = o.Pending[n:]
+		o.Lock.Unlock()
+		if n == 0 {
+			return
+		}
+		tracing := &config.Get().Tracing
+		if !tracing.Exporting() {
+			SpansTotal.Add(float64(n), "dropped")
+			continue
+		}
+		err := otlp.Export(tracing.Endpoint, tracing.ExportTimeout(), otlp.Create(tracing.Service(), batch))
+		if err != nil {
+			log.Warn("Failed to export %d spans to %s: %s", n, tracing.Endpoint, err)
+			SpansTotal.Add(float64(n), "failed")
+			continue
+		}
+		log.Debug("%d spans exported to %s", n, tracing.Endpoint)
+		SpansTotal.Add(float64(n), "exported")
+	}
+}
+
+// CreateSpan describes a finished client as a server span, named after the
+// method as HTTP semantic conventions want
+func CreateSpan(client *TCPClient, record *AccessRecord) otlp.Span {
+	attributes := []otlp.KeyValue{
+		otlp.String("http.request.method", record.Method),
+		otlp.String("client.address", record.Client),
+		otlp.String("prgoxy.request_id", client.RequestID),
+		otlp.String("prgoxy.listener", record.Listener),
+		otlp.Int("prgoxy.bytes_sent", record.Bytes),
+	}
+	if client.Request.Method == "CONNECT" {
+		attributes = append(attributes, otlp.String("server.address", record.URL))
+	} else if record.URL != "" {
+		attributes = append(attributes, otlp.String("url.full", record.URL))
+	}
+	if record.Status != 0 {
+		attributes = append(attributes, otlp.Int("http.response.status_code", int64(record.Status)))
+	}
+	if record.UserAgent != "" {
+		attributes = append(attributes, otlp.String("user_agent.original", record.UserAgent))
+	}
+	if record.User != "" {
+		attributes = append(attributes, otlp.String("enduser.id", record.User))
+	}
+	if record.Cache != "" {
+		attributes = append(attributes, otlp.String("prgoxy.cache", record.Cache))
+	}
+	if record.Decision != "" {
+		attributes = append(attributes, otlp.String("prgoxy.decision", record.Decision))
+	}
+	name := record.Method
+	if name == "" {
+		name = "HTTP"
+	}
+	span := otlp.Span{
+		TraceID:           client.Trace.TraceID,
+		SpanID:            client.Trace.SpanID,
+		ParentSpanID:      client.Trace.ParentID,
+		Name:              name,
+		Kind:              otlp.SpanKindServer,
+		StartTimeUnixNano: otlp.Time(client.Started),
+		EndTimeUnixNano:   otlp.Time(time.Now()),
+		Attributes:        attributes,
+	}
+	// Server spans only fail on 5xx
+	if record.Status >= 500 {
+		span.Status.Code = otlp.StatusError
+	}
+	return span
+}
@@ -0,0 +1,44 @@
+package model
+
+import "testing"
+
+func TestParseTraceparent(t *testing.T) {
+	const (
+		traceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentID = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		value string
+		want  TraceContext
+		ok    bool
+	}{
+		{"00-" + traceID + "-" + parentID + "-01", TraceContext{TraceID: traceID, ParentID: parentID, Sampled: true}, true},
+		{"00-" + traceID + "-" + parentID + "-00", TraceContext{TraceID: traceID, ParentID: parentID}, true},
+		{" 00-" + traceID + "-" + parentID + "-03 ", TraceContext{TraceID: traceID, ParentID: parentID, Sampled: true}, true},
+		// Later versions may append fields
+		{"01-" + traceID + "-" + parentID + "-01-extra", TraceContext{TraceID: traceID, ParentID: parentID, Sampled: true}, true},
+		{"00-" + traceID + "-" + parentID + "-01-extra", TraceContext{}, false},
+		{"ff-" + traceID + "-" + parentID + "-01", TraceContext{}, false},
+		{"00-00000000000000000000000000000000-" + parentID + "-01", TraceContext{}, false},
+		{"00-" + traceID + "-0000000000000000-01", TraceContext{}, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-" + parentID + "-01", TraceContext{}, false},
+		{"00-" + traceID[:31] + "-" + parentID + "-01", TraceContext{}, false},
+		{"00-" + traceID + "-" + parentID + "-1", TraceContext{}, false},
+		{"00-" + traceID + "-" + parentID, TraceContext{}, false},
+		{"", TraceContext{}, false},
+	}
+	for _, test := range tests {
+		got, ok := ParseTraceparent(test.value)
+		if ok != test.ok || got != test.want {
+			t.Errorf("ParseTraceparent(%q) = %+v, %v, want %+v, %v", test.value, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	trace := TraceContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", Sampled: true}
+	got, ok := ParseTraceparent(trace.Traceparent())
+	if !ok || got.TraceID != trace.TraceID || got.ParentID != trace.SpanID || !got.Sampled {
+		t.Errorf("ParseTraceparent(%q) = %+v, %v", trace.Traceparent(), got, ok)
+	}
+}
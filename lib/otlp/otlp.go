@@ -0,0 +1,129 @@
+// Package otlp exports spans to an OpenTelemetry collector with the JSON
+// encoding of OTLP/HTTP, see
+// https://opentelemetry.io/docs/specs/otlp/#otlphttp
+package otlp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Kinds of spans
+const (
+	SpanKindServer = 2
+	SpanKindClient = 3
+)
+
+// Codes of span status
+const (
+	StatusUnset = 0
+	StatusOK    = 1
+	StatusError = 2
+)
+
+type TracesData struct {
+	ResourceSpans []ResourceSpans `json:"resourceSpans"`
+}
+
+type ResourceSpans struct {
+	Resource   Resource     `json:"resource"`
+	ScopeSpans []ScopeSpans `json:"scopeSpans"`
+}
+
+type Resource struct {
+	Attributes []KeyValue `json:"attributes"`
+}
+
+type ScopeSpans struct {
+	Scope Scope  `json:"scope"`
+	Spans []Span `json:"spans"`
+}
+
+type Scope struct {
+	Name string `json:"name"`
+}
+
+// Ids are lowercase hex, times nanoseconds since the epoch as decimal strings
+type Span struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []KeyValue `json:"attributes,omitempty"`
+	Status            Status     `json:"status"`
+}
+
+type Status struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type KeyValue struct {
+	Key   string   `json:"key"`
+	Value AnyValue `json:"value"`
+}
+
+// Only one of the values is set, 64 bit integers are decimal strings
+type AnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+func String(key string, value string) KeyValue {
+	return KeyValue{Key: key, Value: AnyValue{StringValue: &value}}
+}
+
+func Int(key string, value int64) KeyValue {
+	s := strconv.FormatInt(value, 10)
+	return KeyValue{Key: key, Value: AnyValue{IntValue: &s}}
+}
+
+func Time(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// Create returns the spans of a service as made by PrGoxy
+func Create(service string, spans []Span) *TracesData {
+	return &TracesData{
+		ResourceSpans: []ResourceSpans{
+			{
+				Resource: Resource{
+					Attributes: []KeyValue{String("service.name", service)},
+				},
+				ScopeSpans: []ScopeSpans{
+					{
+						Scope: Scope{Name: "PrGoxy"},
+						Spans: spans,
+					},
+				},
+			},
+		},
+	}
+}
+
+// Export posts the spans to the traces url of a collector
+func Export(endpoint string, timeout time.Duration, data *TracesData) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: timeout}
+	response, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("Collector answered %s", response.Status)
+	}
+	return nil
+}
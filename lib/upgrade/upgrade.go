@@ -0,0 +1,192 @@
+package upgrade
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/WangYihang/PrGoxy/lib/util/log"
+)
+
+// A new process started by Upgrade finds its listening sockets from fd 3 on,
+// in the order of the names in PRGOXY_LISTENERS, and tells its parent it is
+// serving by writing to PRGOXY_READY_FD
+const (
+	envListeners = "PRGOXY_LISTENERS"
+	envReadyFD   = "PRGOXY_READY_FD"
+	firstFD      = 3
+)
+
+// How long the old process waits for the new one to start serving
+var ReadyTimeout = 30 * time.Second
+
+var lock = new(sync.Mutex)
+
+// Sockets inherited from the parent, not yet claimed by Listen
+var inherited = map[string]net.Listener{}
+
+// Sockets in use, handed to the new process on upgrade
+var listeners = map[string]net.Listener{}
+
+func init() {
+	names := os.Getenv(envListeners)
+	if names == "" {
+		return
+	}
+	for i, name := range strings.Split(names, ",") {
+		file := os.NewFile(uintptr(firstFD+i), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			log.Error("Can not use inherited socket %s: %s", name, err)
+			continue
+		}
+		inherited[name] = listener
+	}
+	os.Unsetenv(envListeners)
+}
+
+// Listen returns the socket named name inherited from the previous process,
+// or listens on address if there is none
+func Listen(name string, address string) (net.Listener, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	listener, ok := inherited[name]
+	if ok && sameAddress(listener.Addr(), address) {
+		delete(inherited, name)
+		log.Info("Using inherited socket %s (%s)", name, listener.Addr())
+	} else {
+		var err error
+		listener, err = net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	listeners[name] = listener
+	return listener, nil
+}
+
+// sameAddress tells whether an inherited socket is bound to the configured
+// address, it is not reused if the listener moved
+func sameAddress(addr net.Addr, address string) bool {
+	bound, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	configured, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil || bound.Port != configured.Port {
+		return false
+	}
+	if configured.IP == nil || configured.IP.IsUnspecified() {
+		return bound.IP == nil || bound.IP.IsUnspecified()
+	}
+	return bound.IP.Equal(configured.IP)
+}
+
+// Ready tells the parent process this one is serving, the parent then stops
+// accepting and drains its connections. Inherited sockets nobody claimed are
+// closed.
+func Ready() {
+	lock.Lock()
+	for name, listener := range inherited {
+		log.Warn("Inherited socket %s is no longer configured, closing", name)
+		listener.Close()
+		delete(inherited, name)
+	}
+	lock.Unlock()
+
+	v := os.Getenv(envReadyFD)
+	if v == "" {
+		return
+	}
+	os.Unsetenv(envReadyFD)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return
+	}
+	file := os.NewFile(uintptr(fd), "ready")
+	file.Write([]byte{1})
+	file.Close()
+}
+
+// Upgrade starts a new copy of the executable, with the same arguments, that
+// takes over every listening socket. It returns once the new process is
+// serving, after which the caller should drain and exit.
+func Upgrade() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	lock.Lock()
+	var names []string
+	var files []*os.File
+	for name, listener := range listeners {
+		filer, ok := listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+		file, err := filer.File()
+		if err != nil {
+			lock.Unlock()
+			closeFiles(files)
+			return fmt.Errorf("Can not hand over socket %s: %s", name, err)
+		}
+		names = append(names, name)
+		files = append(files, file)
+	}
+	lock.Unlock()
+	defer closeFiles(files)
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	var env []string
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, envListeners+"=") && !strings.HasPrefix(v, envReadyFD+"=") {
+			env = append(env, v)
+		}
+	}
+	env = append(env,
+		envListeners+"="+strings.Join(names, ","),
+		envReadyFD+"="+strconv.Itoa(firstFD+len(files)),
+	)
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return err
+	}
+	log.Info("Started new process %d", cmd.Process.Pid)
+	// Reap the new process if it dies while we are still around
+	go cmd.Wait()
+
+	// The pipe is closed without a byte if the new process exits early
+	ready.SetReadDeadline(time.Now().Add(ReadyTimeout))
+	buffer := make([]byte, 1)
+	n, err := ready.Read(buffer)
+	if n != 1 {
+		cmd.Process.Kill()
+		return fmt.Errorf("New process %d did not get ready: %v", cmd.Process.Pid, err)
+	}
+	return nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
@@ -0,0 +1,197 @@
+package log
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	RotateHourly = "hourly"
+	RotateDaily  = "daily"
+)
+
+type FileSettings struct {
+	// Log file, not written if unset
+	Path string `json:"path"`
+	// Rotate once the file would grow past this many megabytes, 0 never
+	MaxSize int `json:"max_size"`
+	// Rotate at the start of every hour or day: hourly or daily
+	Rotate string `json:"rotate"`
+	// Rotated files to keep, 0 keeps them all
+	MaxBackups int `json:"max_backups"`
+	// Gzip rotated files
+	Compress bool `json:"compress"`
+}
+
+func (settings *FileSettings) Validate() error {
+	if settings.MaxSize < 0 || settings.MaxBackups < 0 {
+		return fmt.Errorf("Invalid log file settings: %+v", *settings)
+	}
+	switch settings.Rotate {
+	case "", RotateHourly, RotateDaily:
+		return nil
+	}
+	return fmt.Errorf("Invalid log rotation: %q", settings.Rotate)
+}
+
+// RotatingFile appends to a log file and moves it aside to
+// path.YYYYMMDD-HHMMSS(.gz) by size or time
+type RotatingFile struct {
+	Settings FileSettings
+	File     *os.File
+	Size     int64
+	// Start of the rotation period the file was opened in
+	Period time.Time
+}
+
+func CreateRotatingFile(settings FileSettings) (*RotatingFile, error) {
+	o := &RotatingFile{
+		Settings: settings,
+	}
+	err := o.open(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *RotatingFile) open(t time.Time) error {
+	file, err := os.OpenFile(o.Settings.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to open log file: %s", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Failed to open log file: %s", err)
+	}
+	o.File = file
+	o.Size = info.Size()
+	o.Period = o.periodStart(t)
+	return nil
+}
+
+func (o *RotatingFile) periodStart(t time.Time) time.Time {
+	switch o.Settings.Rotate {
+	case RotateHourly:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case RotateDaily:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	}
+	return time.Time{}
+}
+
+func (o *RotatingFile) due(t time.Time, size int) bool {
+	if o.Settings.MaxSize > 0 && o.Size > 0 && o.Size+int64(size) > int64(o.Settings.MaxSize)<<20 {
+		return true
+	}
+	return !o.periodStart(t).Equal(o.Period)
+}
+
+func (o *RotatingFile) Write(t time.Time, level string, message string) error {
+	line := FormatLine(t, level, message)
+	if o.due(t, len(line)) {
+		err := o.rotate(t)
+		if err != nil {
+			return err
+		}
+	}
+	n, err := o.File.WriteString(line)
+	o.Size += int64(n)
+	return err
+}
+
+// rotate moves the file aside and starts a new one, compression and removal
+// of old files happen in the background
+func (o *RotatingFile) rotate(t time.Time) error {
+	o.File.Close()
+	backup := o.Settings.Path + "." + t.Format("20060102-150405")
+	for i := 1; exists(backup) || exists(backup+".gz"); i++ {
+		backup = fmt.Sprintf("%s.%s-%d", o.Settings.Path, t.Format("20060102-150405"), i)
+	}
+	err := os.Rename(o.Settings.Path, backup)
+	if err != nil {
+		// Keep appending to the old file rather than losing lines
+		o.open(t)
+		return fmt.Errorf("Failed to rotate log file: %s", err)
+	}
+	err = o.open(t)
+	if err != nil {
+		return err
+	}
+	settings := o.Settings
+	go func() {
+		if settings.Compress {
+			compress(backup)
+		}
+		prune(settings)
+	}()
+	return nil
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func compress(path string) {
+	in, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+	writer := gzip.NewWriter(out)
+	_, err = io.Copy(writer, in)
+	if err == nil {
+		err = writer.Close()
+	}
+	out.Close()
+	if err != nil {
+		os.Remove(path + ".gz")
+		return
+	}
+	os.Remove(path)
+}
+
+// prune removes the oldest rotated files beyond MaxBackups
+func prune(settings FileSettings) {
+	if settings.MaxBackups <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(settings.Path + ".[0-9]*")
+	if err != nil {
+		return
+	}
+	// Files being compressed show up twice, count them once
+	var backups []string
+	for _, match := range matches {
+		if !strings.HasSuffix(match, ".gz") && exists(match+".gz") {
+			continue
+		}
+		backups = append(backups, match)
+	}
+	// Timestamps sort in order
+	sort.Strings(backups)
+	for len(backups) > settings.MaxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+func (o *RotatingFile) Sync() error {
+	return o.File.Sync()
+}
+
+func (o *RotatingFile) Close() error {
+	return o.File.Close()
+}
@@ -2,15 +2,16 @@ package log
 
 import (
 	"fmt"
-	"log"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fatih/color"
+	"github.com/mattn/go-isatty"
 )
 
-var logger = log.New(os.Stderr, "", log.Ldate|log.Ltime)
-
 const (
 	debug   = "[DEBUG]"
 	info    = "[INFO]"
@@ -21,97 +22,169 @@ const (
 	tunnel  = "[TUNNEL]"
 )
 
-var enabled = []string{
+// Levels from the most to the least verbose
+var levels = []string{
+	data,
+	debug,
 	info,
-	// err,
-	warn,
-	// debug,
-	success,
-	// data,
 	tunnel,
+	success,
+	warn,
+	err,
 }
 
-func printMessagePrefix(colorNumber color.Attribute, message string) {
-	color.New(colorNumber).Printf(message + " ")
-	color.New(color.FgHiBlack).Printf(formatTime() + " ")
+// Index in levels of the most verbose level logged, info by default
+var threshold int32 = 2
+
+// Colors of the levels on a terminal
+var colors = map[string]color.Attribute{
+	data:    color.FgMagenta,
+	debug:   color.FgYellow,
+	info:    color.FgBlue,
+	tunnel:  color.FgCyan,
+	success: color.FgGreen,
+	warn:    color.FgMagenta,
+	err:     color.FgRed,
 }
 
-func Tunnel(format string, a ...interface{}) {
-	for _, mode := range enabled {
-		if mode == "[TUNNEL]" {
-			color.Set(color.FgCyan)
-			logger.Print(fmt.Sprintf(format, a...))
-			color.Unset()
-			return
-		}
-	}
+// Output receives every line logged, already filtered by level
+type Output interface {
+	Write(t time.Time, level string, message string) error
+	Close() error
 }
 
-func Data(format string, a ...interface{}) {
-	for _, mode := range enabled {
-		if mode == "[DATA]" {
-			color.Set(color.FgMagenta)
-			logger.Print(fmt.Sprintf(format, a...))
-			color.Unset()
-			return
-		}
+var (
+	// Guards outputs, settings and the console
+	lock    = new(sync.Mutex)
+	console = CreateConsole(os.Stderr, ColorAuto)
+	outputs []Output
+	// Settings last applied by Configure
+	applied Settings
+)
+
+// SetLevel enables the given level and every level less verbose than it,
+// level is one of data, debug, info, tunnel, success, warn and error
+func SetLevel(level string) error {
+	i, ok := levelIndex(level)
+	if !ok {
+		return fmt.Errorf("Unknown log level: %s", level)
 	}
+	atomic.StoreInt32(&threshold, int32(i))
+	return nil
 }
 
-func Debug(format string, a ...interface{}) {
-	for _, mode := range enabled {
-		if mode == "[DEBUG]" {
-			color.Set(color.FgYellow)
-			logger.Print(fmt.Sprintf(format, a...))
-			color.Unset()
-			return
+// Level returns the most verbose level logged
+func Level() string {
+	level := levels[atomic.LoadInt32(&threshold)]
+	return strings.ToLower(level[1 : len(level)-1])
+}
+
+func levelIndex(level string) (int, bool) {
+	mode := "[" + strings.ToUpper(level) + "]"
+	for i, v := range levels {
+		if v == mode {
+			return i, true
 		}
 	}
+	return 0, false
 }
 
-func Info(format string, a ...interface{}) {
-	for _, mode := range enabled {
-		if mode == "[INFO]" {
-			color.Set(color.FgBlue)
-			logger.Print(fmt.Sprintf(format, a...))
-			color.Unset()
-			return
+func enabled(level string) bool {
+	i, _ := levelIndex(level[1 : len(level)-1])
+	return int32(i) >= atomic.LoadInt32(&threshold)
+}
+
+// Flush writes out pending log output, called before exiting
+func Flush() {
+	lock.Lock()
+	defer lock.Unlock()
+	os.Stderr.Sync()
+	for _, output := range outputs {
+		if file, ok := output.(*RotatingFile); ok {
+			file.Sync()
 		}
 	}
 }
 
-func Error(format string, a ...interface{}) {
-	for _, mode := range enabled {
-		if mode == "[ERROR]" {
-			color.Set(color.FgRed)
-			logger.Print(fmt.Sprintf(format, a...))
-			color.Unset()
-			return
+func logf(level string, format string, a ...interface{}) {
+	if !enabled(level) {
+		return
+	}
+	message := fmt.Sprintf(format, a...)
+	t := time.Now()
+	lock.Lock()
+	defer lock.Unlock()
+	console.Write(t, level, message)
+	for _, output := range outputs {
+		e := output.Write(t, level, message)
+		if e != nil {
+			console.Write(t, err, fmt.Sprintf("Failed to write log output: %s", e))
 		}
 	}
 }
-func Warn(format string, a ...interface{}) {
-	for _, mode := range enabled {
-		if mode == "[WARN]" {
-			color.Set(color.FgMagenta)
-			logger.Print(fmt.Sprintf(format, a...))
-			color.Unset()
-			return
-		}
+
+// FormatLine formats a line the way the console and log files show it
+func FormatLine(t time.Time, level string, message string) string {
+	return fmt.Sprintf("%s %s %s\n", t.Format("2006/01/02 15:04:05"), level, message)
+}
+
+// Console writes to a terminal or a pipe, in color if wanted
+type Console struct {
+	File  *os.File
+	Color bool
+}
+
+func CreateConsole(file *os.File, mode string) *Console {
+	colored := mode == ColorAlways
+	if mode == ColorAuto || mode == "" {
+		fd := file.Fd()
+		colored = os.Getenv("NO_COLOR") == "" && (isatty.IsTerminal(fd) || isatty.IsCygwinTerminal(fd))
+	}
+	return &Console{
+		File:  file,
+		Color: colored,
 	}
 }
 
-func Success(format string, a ...interface{}) {
-	for _, mode := range enabled {
-		if mode == "[SUCCESS]" {
-			color.Set(color.FgGreen)
-			logger.Print(fmt.Sprintf(format, a...))
-			color.Unset()
-			return
-		}
+func (o *Console) Write(t time.Time, level string, message string) error {
+	line := FormatLine(t, level, message)
+	if o.Color {
+		c := color.New(colors[level])
+		c.EnableColor()
+		line = c.Sprint(strings.TrimSuffix(line, "\n")) + "\n"
 	}
+	_, e := o.File.WriteString(line)
+	return e
+}
+
+func (o *Console) Close() error {
+	return nil
+}
+
+func Tunnel(format string, a ...interface{}) {
+	logf(tunnel, format, a...)
+}
+
+func Data(format string, a ...interface{}) {
+	logf(data, format, a...)
 }
 
-func formatTime() string {
-	return time.Now().Format("2006/01/02 15:04:05")
+func Debug(format string, a ...interface{}) {
+	logf(debug, format, a...)
+}
+
+func Info(format string, a ...interface{}) {
+	logf(info, format, a...)
+}
+
+func Error(format string, a ...interface{}) {
+	logf(err, format, a...)
+}
+
+func Warn(format string, a ...interface{}) {
+	logf(warn, format, a...)
+}
+
+func Success(format string, a ...interface{}) {
+	logf(success, format, a...)
 }
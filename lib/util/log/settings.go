@@ -0,0 +1,97 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+const (
+	ColorAuto   = "auto"
+	ColorAlways = "always"
+	ColorNever  = "never"
+)
+
+// Settings of the log, part of the config file
+type Settings struct {
+	// Most verbose level logged, info if unset
+	Level string `json:"level"`
+	// auto colors the console only if it is a terminal, auto if unset
+	Color  string         `json:"color"`
+	File   FileSettings   `json:"file"`
+	Syslog SyslogSettings `json:"syslog"`
+}
+
+func (settings *Settings) Validate() error {
+	if settings.Level != "" {
+		if _, ok := levelIndex(settings.Level); !ok {
+			return fmt.Errorf("Unknown log level: %s", settings.Level)
+		}
+	}
+	switch settings.Color {
+	case "", ColorAuto, ColorAlways, ColorNever:
+	default:
+		return fmt.Errorf("Invalid log color: %q", settings.Color)
+	}
+	err := settings.File.Validate()
+	if err != nil {
+		return err
+	}
+	return settings.Syslog.Validate()
+}
+
+// Configure switches the log to new settings, outputs are only reopened when
+// their settings changed. The level is only set when it changed too, so a
+// level set at runtime survives reloads that leave it alone.
+func Configure(settings Settings) error {
+	lock.Lock()
+	defer lock.Unlock()
+	var file, syslog Output
+	var e error
+	if settings.File != applied.File && settings.File.Path != "" {
+		file, e = CreateRotatingFile(settings.File)
+		if e != nil {
+			return e
+		}
+	}
+	if settings.Syslog != applied.Syslog && settings.Syslog.Address != "" {
+		syslog, e = CreateSyslog(settings.Syslog)
+		if e != nil {
+			if file != nil {
+				file.Close()
+			}
+			return e
+		}
+	}
+	var kept []Output
+	for _, output := range outputs {
+		switch output.(type) {
+		case *RotatingFile:
+			if settings.File != applied.File {
+				output.Close()
+				continue
+			}
+		case *Syslog:
+			if settings.Syslog != applied.Syslog {
+				output.Close()
+				continue
+			}
+		}
+		kept = append(kept, output)
+	}
+	for _, output := range []Output{file, syslog} {
+		if output != nil {
+			kept = append(kept, output)
+		}
+	}
+	outputs = kept
+	if settings.Color != applied.Color {
+		console = CreateConsole(os.Stderr, settings.Color)
+	}
+	if settings.Level != applied.Level && settings.Level != "" {
+		i, _ := levelIndex(settings.Level)
+		atomic.StoreInt32(&threshold, int32(i))
+	}
+	applied = settings
+	return nil
+}
@@ -0,0 +1,120 @@
+package log
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+type SyslogSettings struct {
+	// host:port of a syslog server, messages are sent over UDP
+	Address string `json:"address"`
+	// Facility name, local0 if unset
+	Facility string `json:"facility"`
+	// APP-NAME of messages, prgoxy if unset
+	Tag string `json:"tag"`
+}
+
+var facilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// Syslog severities of the levels
+var severities = map[string]int{
+	data:    7,
+	debug:   7,
+	info:    6,
+	tunnel:  6,
+	success: 5,
+	warn:    4,
+	err:     3,
+}
+
+func (settings *SyslogSettings) Validate() error {
+	if settings.Address == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(settings.Address); err != nil {
+		return fmt.Errorf("Invalid syslog address %q: %s", settings.Address, err)
+	}
+	if _, ok := facilities[settings.Facility]; settings.Facility != "" && !ok {
+		return fmt.Errorf("Unknown syslog facility: %q", settings.Facility)
+	}
+	return nil
+}
+
+// Syslog sends lines as RFC 5424 messages
+type Syslog struct {
+	Conn     net.Conn
+	Facility int
+	Hostname string
+	Tag      string
+}
+
+func CreateSyslog(settings SyslogSettings) (*Syslog, error) {
+	conn, err := net.Dial("udp", settings.Address)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to syslog: %s", err)
+	}
+	facility, ok := facilities[settings.Facility]
+	if !ok {
+		facility = facilities["local0"]
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	tag := settings.Tag
+	if tag == "" {
+		tag = "prgoxy"
+	}
+	return &Syslog{
+		Conn:     conn,
+		Facility: facility,
+		Hostname: hostname,
+		Tag:      tag,
+	}, nil
+}
+
+// Write sends one message, without message id or structured data. Send
+// errors are dropped, a syslog server that is down must not flood the console.
+//
+//	<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID - - MSG
+func (o *Syslog) Write(t time.Time, level string, message string) error {
+	fmt.Fprintf(
+		o.Conn,
+		"<%d>1 %s %s %s %d - - %s %s",
+		o.Facility*8+severities[level],
+		t.Format("2006-01-02T15:04:05.000000Z07:00"),
+		o.Hostname,
+		o.Tag,
+		os.Getpid(),
+		level,
+		message,
+	)
+	return nil
+}
+
+func (o *Syslog) Close() error {
+	return o.Conn.Close()
+}
@@ -0,0 +1,101 @@
+package log
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// listenSyslog starts a local UDP syslog server
+func listenSyslog(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func receive(t *testing.T, conn *net.UDPConn) string {
+	buffer := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatalf("No syslog message received: %s", err)
+	}
+	return string(buffer[:n])
+}
+
+func TestSyslogWrite(t *testing.T) {
+	server := listenSyslog(t)
+	syslog, err := CreateSyslog(SyslogSettings{
+		Address:  server.LocalAddr().String(),
+		Facility: "local3",
+		Tag:      "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syslog.Close()
+	at := time.Date(2024, 3, 1, 12, 30, 45, 123456000, time.UTC)
+	syslog.Write(at, warn, "Website (a.test) is blocked")
+	// local3 * 8 + warning
+	want := fmt.Sprintf("<156>1 2024-03-01T12:30:45.123456Z %s test %d - - [WARN] Website (a.test) is blocked", syslog.Hostname, os.Getpid())
+	if got := receive(t, server); got != want {
+		t.Errorf("message = %q, want %q", got, want)
+	}
+}
+
+func TestSyslogDefaults(t *testing.T) {
+	server := listenSyslog(t)
+	// err is the error level in this package
+	syslog, e := CreateSyslog(SyslogSettings{Address: server.LocalAddr().String()})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer syslog.Close()
+	syslog.Write(time.Now(), err, "Read from client failed")
+	// local0 * 8 + error, tag prgoxy
+	pattern := regexp.MustCompile(`^<131>1 \S+ \S+ prgoxy \d+ - - \[ERROR\] Read from client failed$`)
+	if got := receive(t, server); !pattern.MatchString(got) {
+		t.Errorf("message = %q, want match of %s", got, pattern)
+	}
+}
+
+func TestConfigureSyslog(t *testing.T) {
+	server := listenSyslog(t)
+	e := Configure(Settings{
+		Syslog: SyslogSettings{Address: server.LocalAddr().String()},
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer Configure(Settings{})
+	Info("Server running at: %s", "127.0.0.1:8080")
+	pattern := regexp.MustCompile(`\[INFO\] Server running at: 127\.0\.0\.1:8080$`)
+	if got := receive(t, server); !pattern.MatchString(got) {
+		t.Errorf("message = %q, want match of %s", got, pattern)
+	}
+}
+
+func TestSyslogSettingsValidate(t *testing.T) {
+	tests := []struct {
+		settings SyslogSettings
+		valid    bool
+	}{
+		{SyslogSettings{}, true},
+		{SyslogSettings{Address: "127.0.0.1:514"}, true},
+		{SyslogSettings{Address: "127.0.0.1:514", Facility: "daemon"}, true},
+		{SyslogSettings{Address: "127.0.0.1"}, false},
+		{SyslogSettings{Address: "127.0.0.1:514", Facility: "local9"}, false},
+	}
+	for _, test := range tests {
+		e := test.settings.Validate()
+		if (e == nil) != test.valid {
+			t.Errorf("Validate(%+v) = %v, want valid %v", test.settings, e, test.valid)
+		}
+	}
+}